@@ -0,0 +1,137 @@
+package squashfs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+)
+
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// AddFS walks the given fs.FS, adding all of its entries to the image under
+// the given prefix, which may be empty or "." to add the entries to the root.
+//
+// The permissions, including the setuid, setgid and sticky bits, and the
+// modification times of each entry are preserved, as are the device numbers of
+// block and char devices when available.
+//
+// Symlinks are added as symlinks when the fs.FS has a ReadLink method, and
+// are otherwise followed, adding the contents of the file they point to.
+func (b *Builder) AddFS(prefix string, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return b.addFSEntry(fsys, name, path.Join(prefix, name), fi)
+	})
+}
+
+func (b *Builder) addFSEntry(fsys fs.FS, name, p string, fi fs.FileInfo) error {
+	options := []InodeOption{Mode(fsPerms(fi.Mode())), ModTime(fi.ModTime())}
+
+	switch fi.Mode().Type() {
+	case fs.ModeDir:
+		return b.setDir(p, options)
+	case fs.ModeSymlink:
+		if rl, ok := fsys.(readLinkFS); ok {
+			target, err := rl.ReadLink(name)
+			if err != nil {
+				return err
+			}
+
+			return b.Symlink(p, target, options...)
+		}
+
+		fallthrough
+	case 0:
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		return b.File(p, f, options...)
+	case fs.ModeDevice:
+		return b.Block(p, deviceNumber(fi), options...)
+	case fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice:
+		return b.Char(p, deviceNumber(fi), options...)
+	case fs.ModeNamedPipe:
+		return b.FIFO(p, options...)
+	case fs.ModeSocket:
+		return b.Socket(p, options...)
+	}
+
+	return &fs.PathError{
+		Op:   "addfs",
+		Path: name,
+		Err:  fs.ErrInvalid,
+	}
+}
+
+func fsPerms(m fs.FileMode) fs.FileMode {
+	perms := m.Perm()
+
+	if m&fs.ModeSetuid != 0 {
+		perms |= 0o4000
+	}
+
+	if m&fs.ModeSetgid != 0 {
+		perms |= 0o2000
+	}
+
+	if m&fs.ModeSticky != 0 {
+		perms |= 0o1000
+	}
+
+	return perms
+}
+
+func (b *Builder) setDir(p string, options []InodeOption) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, err := b.commonStat(p, options...)
+	if err != nil {
+		return err
+	}
+
+	if p == "." {
+		b.root.commonStat = c
+
+		return nil
+	}
+
+	err = b.addNode(p, b.newDirNode(path.Base(p), c))
+	if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	if d := b.root.getNode(p).AsDir(); d != nil {
+		d.commonStat = c
+
+		return nil
+	}
+
+	return err
+}
+
+func deviceNumber(fi fs.FileInfo) uint32 {
+	switch sys := fi.Sys().(type) {
+	case blockStat:
+		return sys.deviceNumber
+	case charStat:
+		return sys.deviceNumber
+	}
+
+	return sysDeviceNumber(fi.Sys())
+}
@@ -0,0 +1,225 @@
+package squashfs
+
+import (
+	"io"
+	"io/fs"
+
+	"vimagination.zapto.org/byteio"
+)
+
+const fragmentEntryLength = 16
+
+// ReadWriterAt is the combination of io.ReaderAt and io.WriterAt, such as an
+// *os.File.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Append opens the existing SquashFS image in rw and returns a Builder that
+// contains all of its entries.
+//
+// Existing data and fragment blocks are kept in place, with any new data being
+// written after them; the metadata tables and superblock are rewritten when the
+// Builder is closed.
+//
+// As new data is written over the existing metadata tables, the image is
+// unusable until Close returns successfully. If the image must survive a
+// failed build, Append to a copy of it instead.
+//
+// The block size and compressor of the image cannot be changed, and if the
+// writer has a Truncate method, it will be used to remove any excess from the
+// end of the image.
+func Append(rw ReadWriterAt, options ...BuildOption) (*Builder, error) {
+	sfs, err := Open(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBuilder(rw)
+	b.superblock.BlockSize = sfs.superblock.BlockSize
+	b.superblock.Flags = sfs.superblock.Flags & (flagExportable | flagCompressionOptions)
+	b.superblock.CompressionOptions = sfs.superblock.CompressionOptions
+
+	for _, o := range options {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.superblock.BlockSize != sfs.superblock.BlockSize ||
+		b.superblock.CompressionOptions.AsCompressor() != sfs.superblock.Compressor ||
+		b.superblock.dataStart() != sfs.superblock.dataStart() {
+		return nil, ErrIncompatibleImage
+	}
+
+	if err := b.load(sfs); err != nil {
+		return nil, err
+	}
+
+	if err := b.setWriters(int64(sfs.superblock.InodeTable)); err != nil {
+		return nil, err
+	}
+
+	b.blockWriter.end = int64(sfs.superblock.BytesUsed)
+
+	return b, nil
+}
+
+func (b *Builder) load(sfs *SquashFS) error {
+	if err := b.loadIDs(sfs); err != nil {
+		return err
+	}
+
+	if err := b.loadFragments(sfs); err != nil {
+		return err
+	}
+
+	fi, err := sfs.getEntry(sfs.superblock.RootInode, "")
+	if err != nil {
+		return err
+	}
+
+	root, ok := fi.(dirStat)
+	if !ok {
+		return fs.ErrInvalid
+	}
+
+	b.root = b.newDirNode("", root.commonStat)
+
+	return b.loadDir(sfs, b.root, root, make(map[uint32]*entry))
+}
+
+func (b *Builder) loadIDs(sfs *SquashFS) error {
+	if sfs.superblock.IDCount == 0 {
+		return nil
+	}
+
+	r, err := sfs.readMetadataFromLookupTable(int64(sfs.superblock.IDTable), 0, idLength)
+	if err != nil {
+		return err
+	}
+
+	ler := byteio.StickyLittleEndianReader{Reader: r}
+
+	for range sfs.superblock.IDCount {
+		id := ler.ReadUint32()
+
+		if _, ok := b.idIndexes[id]; !ok {
+			b.idIndexes[id] = uint16(len(b.ids))
+			b.ids = append(b.ids, id)
+		}
+	}
+
+	return ler.Err
+}
+
+func (b *Builder) loadFragments(sfs *SquashFS) error {
+	if sfs.superblock.FragCount == 0 || sfs.superblock.FragTable == noTable {
+		return nil
+	}
+
+	r, err := sfs.readMetadataFromLookupTable(int64(sfs.superblock.FragTable), 0, fragmentEntryLength)
+	if err != nil {
+		return err
+	}
+
+	b.fragmentTable = make([]byte, int(sfs.superblock.FragCount)*fragmentEntryLength)
+	b.superblock.FragCount = sfs.superblock.FragCount
+
+	_, err = io.ReadFull(r, b.fragmentTable)
+
+	return err
+}
+
+func (b *Builder) loadDir(sfs *SquashFS, d *dirNode, ds dirStat, inodes map[uint32]*entry) error {
+	xattrs, err := sfs.readXattrs(ds.xattrIndex)
+	if err != nil {
+		return err
+	}
+
+	d.commonStat.xattrs = xattrs
+
+	dir, err := sfs.newDir(ds)
+	if err != nil {
+		return err
+	}
+
+	entries, err := dir.readDir(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, de := range entries {
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+
+		c, err := b.loadEntry(sfs, fi, inodes)
+		if err != nil {
+			return err
+		}
+
+		c.node().links++
+		d.children = append(d.children, c)
+	}
+
+	return nil
+}
+
+func (b *Builder) loadEntry(sfs *SquashFS, fi fs.FileInfo, inodes map[uint32]*entry) (childNode, error) {
+	if ds, ok := fi.(dirStat); ok {
+		d := b.newDirNode(ds.name, ds.commonStat)
+
+		return d, b.loadDir(sfs, d, ds, inodes)
+	}
+
+	var (
+		typ  uint16
+		stat inodeWriter
+	)
+
+	switch fi := fi.(type) {
+	case fileStat:
+		typ, stat = inodeBasicFile, &fi
+	case symlinkStat:
+		typ, stat = inodeBasicSymlink, &fi
+	case blockStat:
+		typ, stat = inodeBasicBlock, &fi
+	case charStat:
+		typ, stat = inodeBasicChar, &fi
+	case fifoStat:
+		typ, stat = inodeBasicPipe, &fi
+	case socketStat:
+		typ, stat = inodeBasicSock, &fi
+	default:
+		return nil, fs.ErrInvalid
+	}
+
+	c := stat.common()
+
+	if e, ok := inodes[c.inode]; ok {
+		return &linkNode{
+			name:  c.name,
+			entry: e,
+		}, nil
+	}
+
+	xattrs, err := sfs.readXattrs(xattrIndex(fi))
+	if err != nil {
+		return nil, err
+	}
+
+	c.xattrs = xattrs
+
+	e := &entry{
+		name: c.name,
+		typ:  typ,
+		stat: stat,
+	}
+
+	inodes[c.inode] = e
+
+	return e, nil
+}
@@ -0,0 +1,222 @@
+package squashfs
+
+const (
+	bcjX86      = 0x04
+	bcjPowerPC  = 0x05
+	bcjIA64     = 0x06
+	bcjARM      = 0x07
+	bcjARMThumb = 0x08
+	bcjSPARC    = 0x09
+)
+
+type bcjFilter func(buf []byte, pos uint32, encode bool)
+
+var bcjFilters = map[uint64]bcjFilter{
+	bcjX86:      bcjX86Filter,
+	bcjPowerPC:  bcjPowerPCFilter,
+	bcjIA64:     bcjIA64Filter,
+	bcjARM:      bcjARMFilter,
+	bcjARMThumb: bcjARMThumbFilter,
+	bcjSPARC:    bcjSPARCFilter,
+}
+
+func bcjConvert(encode bool, pos, src uint32) uint32 {
+	if encode {
+		return src + pos
+	}
+
+	return src - pos
+}
+
+func bcjX86TestMSByte(b byte) bool {
+	return b == 0x00 || b == 0xff
+}
+
+var (
+	bcjX86MaskAllowed = [8]bool{true, true, true, false, true, false, false, false}
+	bcjX86MaskBit     = [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+)
+
+func bcjX86Filter(buf []byte, pos uint32, encode bool) {
+	if len(buf) < 5 {
+		return
+	}
+
+	var prevMask uint32
+
+	prevPos := pos - 5
+
+	for i := 0; i <= len(buf)-5; {
+		b := buf[i]
+		if b != 0xe8 && b != 0xe9 {
+			i++
+
+			continue
+		}
+
+		now := pos + uint32(i)
+		offset := now - prevPos
+		prevPos = now
+
+		if offset > 5 {
+			prevMask = 0
+		} else {
+			for range offset {
+				prevMask &= 0x77
+				prevMask <<= 1
+			}
+		}
+
+		b = buf[i+4]
+
+		if !bcjX86TestMSByte(b) || !bcjX86MaskAllowed[(prevMask>>1)&7] || prevMask>>1 >= 0x10 {
+			i++
+			prevMask |= 1
+
+			if bcjX86TestMSByte(b) {
+				prevMask |= 0x10
+			}
+
+			continue
+		}
+
+		src := uint32(b)<<24 | uint32(buf[i+3])<<16 | uint32(buf[i+2])<<8 | uint32(buf[i+1])
+
+		var dest uint32
+
+		for {
+			dest = bcjConvert(encode, now+5, src)
+
+			if prevMask == 0 {
+				break
+			}
+
+			j := bcjX86MaskBit[prevMask>>1] * 8
+			if !bcjX86TestMSByte(byte(dest >> (24 - j))) {
+				break
+			}
+
+			src = dest ^ (1<<(32-j) - 1)
+		}
+
+		buf[i+4] = ^byte((dest>>24)&1 - 1)
+		buf[i+3] = byte(dest >> 16)
+		buf[i+2] = byte(dest >> 8)
+		buf[i+1] = byte(dest)
+		i += 5
+		prevMask = 0
+	}
+}
+
+func bcjPowerPCFilter(buf []byte, pos uint32, encode bool) {
+	for i := 0; i+4 <= len(buf); i += 4 {
+		if buf[i]>>2 != 0x12 || buf[i+3]&3 != 1 {
+			continue
+		}
+
+		src := uint32(buf[i]&3)<<24 | uint32(buf[i+1])<<16 | uint32(buf[i+2])<<8 | uint32(buf[i+3]&^3)
+		dest := bcjConvert(encode, pos+uint32(i), src)
+
+		buf[i] = 0x48 | byte(dest>>24)&3
+		buf[i+1] = byte(dest >> 16)
+		buf[i+2] = byte(dest >> 8)
+		buf[i+3] = buf[i+3]&3 | byte(dest)
+	}
+}
+
+var bcjIA64BranchTable = [32]uint32{
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	4, 4, 6, 6, 0, 0, 7, 7,
+	4, 4, 0, 0, 4, 4, 0, 0,
+}
+
+func bcjIA64Filter(buf []byte, pos uint32, encode bool) {
+	for i := 0; i+16 <= len(buf); i += 16 {
+		mask := bcjIA64BranchTable[buf[i]&0x1f]
+
+		for slot, bitPos := 0, 5; slot < 3; slot, bitPos = slot+1, bitPos+41 {
+			if (mask>>slot)&1 == 0 {
+				continue
+			}
+
+			bytePos := i + bitPos>>3
+			bitRes := bitPos & 7
+
+			var instruction uint64
+
+			for j := range 6 {
+				instruction |= uint64(buf[bytePos+j]) << (8 * j)
+			}
+
+			norm := instruction >> bitRes
+
+			if (norm>>37)&0xf != 0x5 || (norm>>9)&7 != 0 {
+				continue
+			}
+
+			src := uint32((norm>>13)&0xfffff) | uint32((norm>>36)&1)<<20
+			dest := bcjConvert(encode, pos+uint32(i), src<<4) >> 4
+
+			norm &^= 0x8fffff << 13
+			norm |= uint64(dest&0xfffff) << 13
+			norm |= uint64(dest&0x100000) << (36 - 20)
+
+			instruction &= 1<<bitRes - 1
+			instruction |= norm << bitRes
+
+			for j := range 6 {
+				buf[bytePos+j] = byte(instruction >> (8 * j))
+			}
+		}
+	}
+}
+
+func bcjARMFilter(buf []byte, pos uint32, encode bool) {
+	for i := 0; i+4 <= len(buf); i += 4 {
+		if buf[i+3] != 0xeb {
+			continue
+		}
+
+		src := (uint32(buf[i+2])<<16 | uint32(buf[i+1])<<8 | uint32(buf[i])) << 2
+		dest := bcjConvert(encode, pos+uint32(i)+8, src) >> 2
+
+		buf[i+2] = byte(dest >> 16)
+		buf[i+1] = byte(dest >> 8)
+		buf[i] = byte(dest)
+	}
+}
+
+func bcjARMThumbFilter(buf []byte, pos uint32, encode bool) {
+	for i := 0; i+4 <= len(buf); i += 2 {
+		if buf[i+1]&0xf8 != 0xf0 || buf[i+3]&0xf8 != 0xf8 {
+			continue
+		}
+
+		src := (uint32(buf[i+1]&7)<<19 | uint32(buf[i])<<11 | uint32(buf[i+3]&7)<<8 | uint32(buf[i+2])) << 1
+		dest := bcjConvert(encode, pos+uint32(i)+4, src) >> 1
+
+		buf[i+1] = 0xf0 | byte(dest>>19)&7
+		buf[i] = byte(dest >> 11)
+		buf[i+3] = 0xf8 | byte(dest>>8)&7
+		buf[i+2] = byte(dest)
+		i += 2
+	}
+}
+
+func bcjSPARCFilter(buf []byte, pos uint32, encode bool) {
+	for i := 0; i+4 <= len(buf); i += 4 {
+		if !(buf[i] == 0x40 && buf[i+1]&0xc0 == 0x00) && !(buf[i] == 0x7f && buf[i+1]&0xc0 == 0xc0) {
+			continue
+		}
+
+		src := (uint32(buf[i])<<24 | uint32(buf[i+1])<<16 | uint32(buf[i+2])<<8 | uint32(buf[i+3])) << 2
+		dest := bcjConvert(encode, pos+uint32(i), src) >> 2
+		dest = ((0-(dest>>22)&1)<<22)&0x3fffffff | dest&0x3fffff | 0x40000000
+
+		buf[i] = byte(dest >> 24)
+		buf[i+1] = byte(dest >> 16)
+		buf[i+2] = byte(dest >> 8)
+		buf[i+3] = byte(dest)
+	}
+}
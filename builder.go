@@ -1,17 +1,19 @@
 package squashfs
 
 import (
+	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
 	"io/fs"
 	"path"
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"vimagination.zapto.org/byteio"
 	"vimagination.zapto.org/memio"
-	"vimagination.zapto.org/rwcount"
 )
 
 const (
@@ -30,25 +32,26 @@ type Builder struct {
 	blockWriter    blockWriter
 	inodeTable     metadataWriter
 	fragmentBuffer memio.Buffer
-	fragmentTable  metadataWriter
-	idTable        metadataWriter
+	fragmentTable  memio.Buffer
+	exports        []uint64
+	ids            []uint32
+	idIndexes      map[uint32]uint16
+	xattrTable     metadataWriter
+	xattrIDs       memio.Buffer
+	xattrIndexes   map[string]uint32
+	xattrValues    map[string]uint64
+	dedup          bool
+	workers        int
+	clampTime      time.Time
+	blockRuns      map[[sha256.Size]byte]blockRun
+	fragments      map[[sha256.Size]byte]fragmentRef
 
 	mu   sync.Mutex
 	root *dirNode
 }
 
 func Create(w io.WriterAt, options ...BuildOption) (*Builder, error) {
-	b := &Builder{
-		writer: w,
-		superblock: superblock{
-			Stats: Stats{
-				BlockSize: defaultBlockSize,
-			},
-			CompressionOptions: DefaultGzipOptions(),
-			ExportTable:        noTable,
-		},
-		root: &dirNode{},
-	}
+	b := newBuilder(w)
 
 	for _, o := range options {
 		if err := o(b); err != nil {
@@ -56,29 +59,61 @@ func Create(w io.WriterAt, options ...BuildOption) (*Builder, error) {
 		}
 	}
 
-	if err := b.setWriters(); err != nil {
+	b.root = b.newDirNode("", b.defaultStat)
+
+	if err := b.setWriters(b.superblock.dataStart()); err != nil {
 		return nil, err
 	}
 
 	return b, nil
 }
 
-func (b *Builder) setWriters() error {
-	blockStart := int64(headerLength)
-	if b.superblock.Flags&flagCompressionOptions == 0 {
-		blockStart -= compressionOptionsLength
+func newBuilder(w io.WriterAt) *Builder {
+	return &Builder{
+		writer: w,
+		superblock: superblock{
+			Stats: Stats{
+				BlockSize: defaultBlockSize,
+			},
+			CompressionOptions: DefaultGzipOptions(),
+			ExportTable:        noTable,
+		},
+		defaultStat: commonStat{
+			perms: defaultPerms,
+		},
+		idIndexes:    make(map[uint32]uint16),
+		xattrIndexes: make(map[string]uint32),
+		xattrValues:  make(map[string]uint64),
+		dedup:        true,
+		blockRuns:    make(map[[sha256.Size]byte]blockRun),
+		fragments:    make(map[[sha256.Size]byte]fragmentRef),
 	}
+}
+
+func (b *Builder) setWriters(blockStart int64) error {
+	b.superblock.Compressor = b.superblock.CompressionOptions.AsCompressor()
 
-	c, err := b.superblock.CompressionOptions.getCompressedWriter()
+	c, err := b.superblock.Compressor.compressedWriter(b.superblock.CompressionOptions)
 	if err != nil {
 		return err
 	}
 
+	var workers []CompressedWriter
+
+	if b.workers > 1 {
+		workers = make([]CompressedWriter, b.workers)
+
+		for n := range workers {
+			if workers[n], err = b.superblock.Compressor.compressedWriter(b.superblock.CompressionOptions); err != nil {
+				return err
+			}
+		}
+	}
+
 	b.fragmentBuffer = make(memio.Buffer, 0, b.superblock.BlockSize)
-	b.blockWriter = newBlockWriter(b.writer, blockStart, b.superblock.BlockSize, c)
+	b.blockWriter = newBlockWriter(b.writer, blockStart, b.superblock.BlockSize, c, workers)
 	b.inodeTable = newMetadataWriter(c)
-	b.fragmentTable = newMetadataWriter(c)
-	b.idTable = newMetadataWriter(c)
+	b.xattrTable = newMetadataWriter(c)
 
 	return nil
 }
@@ -87,108 +122,404 @@ func (b *Builder) Dir(p string, options ...InodeOption) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	d := &dirNode{
-		entry: entry{
-			name: path.Base(p),
-		},
-		commonStat: b.commonStat(options...),
+	c, err := b.commonStat(p, options...)
+	if err != nil {
+		return err
 	}
 
-	for _, opt := range options {
-		opt(&d.commonStat)
-	}
+	return b.addNode(p, b.newDirNode(path.Base(p), c))
+}
 
-	if err := b.addNode(p, d); err != nil {
-		return err
+func (b *Builder) newDirNode(name string, c commonStat) *dirNode {
+	return &dirNode{
+		entry: entry{
+			name: name,
+			typ:  inodeBasicDir,
+		},
+		commonStat: c,
 	}
-
-	return nil
 }
 
-func (b *Builder) commonStat(options ...InodeOption) commonStat {
+func (b *Builder) commonStat(p string, options ...InodeOption) (commonStat, error) {
 	c := b.defaultStat
 
 	for _, opt := range options {
 		opt(&c)
 	}
 
-	return c
+	for _, x := range c.xattrs {
+		if err := validateXattr(x); err != nil {
+			return c, &fs.PathError{
+				Op:   "setxattr",
+				Path: p,
+				Err:  err,
+			}
+		}
+	}
+
+	return c, nil
 }
 
 func (b *Builder) addNode(p string, c childNode) error {
+	d, err := b.newNodeParent(p)
+	if err != nil {
+		return err
+	}
+
+	d.insertSortedNode(c)
+
+	c.node().links++
+
+	return nil
+}
+
+// newNodeParent returns the directory that a new node at the given path would
+// be added to, returning an error if the path is invalid or already exists.
+func (b *Builder) newNodeParent(p string) (*dirNode, error) {
 	if !fs.ValidPath(p) {
-		return fs.ErrInvalid
+		return nil, fs.ErrInvalid
 	}
 
 	if p == "." {
-		return fs.ErrExist
+		return nil, fs.ErrExist
 	}
 
-	if o := b.getParent(b.root, p); o == nil {
-		return fs.ErrInvalid
-	} else if c != o.insertSortedNode(c) {
-		return fs.ErrExist
+	d := b.getParent(b.root, p)
+	if d == nil {
+		return nil, fs.ErrInvalid
+	} else if _, exists := d.find(path.Base(p)); exists {
+		return nil, fs.ErrExist
 	}
 
-	return nil
+	return d, nil
+}
+
+// Hole describes a region of a file that contains only zero bytes.
+type Hole struct {
+	Offset, Length int64
+}
+
+// SparseReader can be implemented by the io.Reader passed to Builder.File in
+// order to describe the holes in the file; blocks that lie entirely within a
+// hole will be seeked over instead of being read.
+//
+// Holes should be returned in ascending order, with offsets relative to the
+// current position of the reader.
+//
+// Blocks consisting entirely of zero bytes are stored as holes regardless of
+// whether the reader implements this interface.
+type SparseReader interface {
+	io.ReadSeeker
+	Holes() []Hole
 }
 
 func (b *Builder) File(p string, r io.Reader, options ...InodeOption) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	start := uint64(b.blockWriter.Pos())
-	sr := rwcount.Reader{Reader: r}
+	return b.addFile(p, options, func(f *fileStat, h hash.Hash) ([]byte, error) {
+		if err := b.blockWriter.WriteFile(f, r, h); err != nil {
+			return nil, err
+		}
+
+		return b.blockWriter.uncompressed[:f.fileSize%uint64(b.superblock.BlockSize)], nil
+	})
+}
 
-	sizes, err := b.blockWriter.WriteFile(&sr)
+// addFile adds a file node at the given path, using the write func to write
+// the data blocks of the file and return the fragment data, if any.
+func (b *Builder) addFile(p string, options []InodeOption, write func(*fileStat, hash.Hash) ([]byte, error)) error {
+	c, err := b.commonStat(p, options...)
 	if err != nil {
 		return err
 	}
 
-	if err = b.addNode(p, entry{
-		name:     path.Base(p),
-		metadata: uint32(b.inodeTable.Pos()),
-	}); err != nil {
+	d, err := b.newNodeParent(p)
+	if err != nil {
+		return err
+	}
+
+	f := &fileStat{
+		commonStat: c,
+		xattrIndex: fieldDisabled,
+	}
+
+	var h hash.Hash
+
+	if b.dedup {
+		h = sha256.New()
+	}
+
+	fragment, err := write(f, h)
+	if err != nil {
 		return err
 	}
 
-	fragIndex, blockOffset, err := b.writePossibleFragment(sr.Count)
+	if h != nil {
+		b.dedupBlocks(f, [sha256.Size]byte(h.Sum(nil)))
+	}
+
+	fragIndex, blockOffset, err := b.writePossibleFragment(fragment)
 	if err != nil {
 		return err
 	}
 
-	return b.writeInode(fileStat{
-		commonStat:  b.commonStat(options...),
-		blocksStart: start,
-		fileSize:    uint64(sr.Count),
-		blockSizes:  sizes,
-		fragIndex:   fragIndex,
-		blockOffset: blockOffset,
+	f.fragIndex = fragIndex
+	f.blockOffset = blockOffset
+
+	d.insertSortedNode(&entry{
+		name:  path.Base(p),
+		typ:   inodeBasicFile,
+		links: 1,
+		stat:  f,
 	})
+
+	return nil
+}
+
+type blockRun struct {
+	start uint64
+	sizes []uint32
+}
+
+func (b *Builder) dedupBlocks(f *fileStat, key [sha256.Size]byte) {
+	if len(f.blockSizes) == 0 {
+		return
+	}
+
+	if run, ok := b.blockRuns[key]; ok {
+		if slices.ContainsFunc(f.blockSizes, isBlock) {
+			b.blockWriter.Rewind(int64(f.blocksStart))
+		}
+
+		f.blocksStart = run.start
+		f.blockSizes = run.sizes
+
+		return
+	}
+
+	b.blockRuns[key] = blockRun{
+		start: f.blocksStart,
+		sizes: f.blockSizes,
+	}
+}
+
+func isBlock(size uint32) bool {
+	return size != 0
 }
 
 type inodeWriter interface {
+	common() *commonStat
+	setLinkCount(uint32)
+	setXattrIndex(uint32)
 	writeTo(*byteio.StickyLittleEndianWriter)
 }
 
-func (b *Builder) writeInode(inode inodeWriter) error {
-	b.superblock.Inodes++
+func (b *Builder) writeInode(e *entry) error {
+	e.metadata = uint64(b.inodeTable.Pos())
+	e.written = true
+
+	c := e.stat.common()
+	c.inode = e.inode
+
+	if !b.clampTime.IsZero() && c.mtime.After(b.clampTime) {
+		c.mtime = b.clampTime
+	}
+
+	var err error
+
+	if c.uidIndex, err = b.getIDIndex(c.uid); err != nil {
+		return err
+	}
+
+	if c.gidIndex, err = b.getIDIndex(c.gid); err != nil {
+		return err
+	}
+
+	xattrIndex, err := b.getXattrIndex(c.xattrs)
+	if err != nil {
+		return err
+	}
+
+	e.stat.setLinkCount(e.links)
+	e.stat.setXattrIndex(xattrIndex)
 
 	lew := byteio.StickyLittleEndianWriter{Writer: &b.inodeTable}
 
-	inode.writeTo(&lew)
+	e.stat.writeTo(&lew)
+
+	if b.superblock.Flags&flagExportable != 0 {
+		b.exportInode(e)
+	}
 
 	return lew.Err
 }
 
-func (b *Builder) writePossibleFragment(totalSize int64) (uint32, uint32, error) {
-	fragmentLength := uint64(totalSize) % uint64(b.superblock.BlockSize)
+func (b *Builder) exportInode(e *entry) {
+	if n := int(e.inode); n > len(b.exports) {
+		b.exports = append(b.exports, make([]uint64, n-len(b.exports))...)
+	}
+
+	b.exports[e.inode-1] = e.metadata
+}
+
+func (b *Builder) exportTable() []byte {
+	buf := make(memio.Buffer, 0, len(b.exports)*exportLength)
+	lew := byteio.LittleEndianWriter{Writer: &buf}
+
+	for _, ref := range b.exports {
+		lew.WriteUint64(ref)
+	}
+
+	return buf
+}
+
+func (b *Builder) getIDIndex(id uint32) (uint16, error) {
+	if idx, ok := b.idIndexes[id]; ok {
+		return idx, nil
+	}
+
+	if len(b.ids) == maxIDs {
+		return 0, ErrTooManyIDs
+	}
+
+	idx := uint16(len(b.ids))
+
+	b.ids = append(b.ids, id)
+	b.idIndexes[id] = idx
+
+	return idx, nil
+}
+
+func (b *Builder) idTable() []byte {
+	buf := make(memio.Buffer, 0, len(b.ids)*idLength)
+	lew := byteio.LittleEndianWriter{Writer: &buf}
+
+	for _, id := range b.ids {
+		lew.WriteUint32(id)
+	}
+
+	return buf
+}
+
+func (b *Builder) getXattrIndex(xattrs []xattr) (uint32, error) {
+	if len(xattrs) == 0 {
+		return fieldDisabled, nil
+	}
+
+	xattrs = slices.Clone(xattrs)
+
+	slices.SortFunc(xattrs, func(a, b xattr) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	key, err := xattrSetKey(xattrs)
+	if err != nil {
+		return 0, err
+	}
+
+	if idx, ok := b.xattrIndexes[key]; ok {
+		return idx, nil
+	}
+
+	ref := uint64(b.xattrTable.Pos())
+	lew := byteio.StickyLittleEndianWriter{Writer: &b.xattrTable}
+
+	for _, x := range xattrs {
+		typ, name := xattrType(x.key)
+		value := string(x.value)
+
+		if pos, ok := b.xattrValues[value]; ok {
+			lew.WriteUint16(typ | xattrValueOOL)
+			lew.WriteString16(name)
+			lew.WriteUint32(xattrOOLLength)
+			lew.WriteUint64(pos)
+
+			continue
+		}
+
+		lew.WriteUint16(typ)
+		lew.WriteString16(name)
+
+		if len(value) > xattrOOLLength {
+			b.xattrValues[value] = uint64(b.xattrTable.Pos())
+		}
+
+		lew.WriteUint32(uint32(len(value)))
+		lew.WriteString(value)
+	}
+
+	if lew.Err != nil {
+		return 0, lew.Err
+	}
+
+	idx := uint32(len(b.xattrIDs) / xattrIDLength)
+	ilew := byteio.LittleEndianWriter{Writer: &b.xattrIDs}
+
+	ilew.WriteUint64(ref)
+	ilew.WriteUint32(uint32(len(xattrs)))
+	ilew.WriteUint32(uint32(lew.Count))
+
+	b.xattrIndexes[key] = idx
+
+	return idx, nil
+}
+
+func xattrSetKey(xattrs []xattr) (string, error) {
+	var buf memio.Buffer
+
+	lew := byteio.StickyLittleEndianWriter{Writer: &buf}
+
+	for n, x := range xattrs {
+		if err := validateXattr(x); err != nil {
+			return "", err
+		} else if n > 0 && xattrs[n-1].key == x.key {
+			return "", ErrInvalidXattr
+		}
+
+		typ, name := xattrType(x.key)
+
+		lew.WriteUint16(typ)
+		lew.WriteString16(name)
+		lew.WriteUint32(uint32(len(x.value)))
+		lew.Write(x.value)
+	}
+
+	return string(buf), lew.Err
+}
+
+func validateXattr(x xattr) error {
+	if _, name := xattrType(x.key); name == "" || len(name) > 0xffff || len(x.value) > maxXattrValueLength {
+		return ErrInvalidXattr
+	}
+
+	return nil
+}
 
-	if fragmentLength == 0 {
+func xattrType(key string) (uint16, string) {
+	for typ, prefix := range xattrPrefixes {
+		if name, ok := strings.CutPrefix(key, prefix); ok {
+			return uint16(typ), name
+		}
+	}
+
+	return 0, ""
+}
+
+func (b *Builder) writePossibleFragment(fragment []byte) (uint32, uint32, error) {
+	if len(fragment) == 0 {
 		return fieldDisabled, 0, nil
 	}
 
-	fragment := b.blockWriter.uncompressed[:fragmentLength]
+	var key [sha256.Size]byte
+
+	if b.dedup {
+		key = sha256.Sum256(fragment)
+
+		if ref, ok := b.fragments[key]; ok {
+			return ref.index, ref.offset, nil
+		}
+	}
 
 	if len(fragment) > cap(b.fragmentBuffer)-len(b.fragmentBuffer) {
 		if err := b.writeFragments(); err != nil {
@@ -196,32 +527,48 @@ func (b *Builder) writePossibleFragment(totalSize int64) (uint32, uint32, error)
 		}
 	}
 
-	fragIndex := uint32(b.fragmentTable.Pos())
+	fragIndex := b.superblock.FragCount
 	blockOffset := uint32(len(b.fragmentBuffer))
 
 	b.fragmentBuffer = append(b.fragmentBuffer, fragment...)
 
+	if b.dedup {
+		b.fragments[key] = fragmentRef{
+			index:  fragIndex,
+			offset: blockOffset,
+		}
+	}
+
 	return fragIndex, blockOffset, nil
 }
 
-func (b *Builder) writeFragments() error {
-	fragPos := uint64(b.blockWriter.Pos())
-
-	n, err := b.blockWriter.WriteFragments(b.fragmentBuffer)
-	if err != nil {
+func (b *Builder) writeFragmentEntry(pos int64, size uint32) error {
+	lew := byteio.LittleEndianWriter{Writer: &b.fragmentTable}
+	if _, err := lew.WriteUint64(uint64(pos)); err != nil {
 		return err
 	}
 
-	lew := byteio.LittleEndianWriter{Writer: &b.fragmentTable}
-	if _, err := lew.WriteUint64(fragPos); err != nil {
+	if _, err := lew.WriteUint32(size); err != nil {
 		return err
 	}
 
-	if _, err := lew.WriteUint32(uint32(n)); err != nil {
+	if _, err := lew.WriteUint32(0); err != nil {
 		return err
 	}
 
-	if _, err := lew.WriteUint32(0); err != nil {
+	return nil
+}
+
+type fragmentRef struct {
+	index, offset uint32
+}
+
+func (b *Builder) writeFragments() error {
+	if len(b.fragmentBuffer) == 0 {
+		return nil
+	}
+
+	if err := b.blockWriter.WriteFragments(b.fragmentBuffer, b.writeFragmentEntry); err != nil {
 		return err
 	}
 
@@ -235,16 +582,42 @@ func (b *Builder) Symlink(p, dest string, options ...InodeOption) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if err := b.addNode(p, entry{
-		name: path.Base(p),
-	}); err != nil {
+	c, err := b.commonStat(p, options...)
+	if err != nil {
 		return err
 	}
 
-	return b.writeInode(symlinkStat{
-		commonStat: b.commonStat(options...),
-		linkCount:  1,
-		targetPath: dest,
+	return b.addNode(p, &entry{
+		name: path.Base(p),
+		typ:  inodeBasicSymlink,
+		stat: &symlinkStat{
+			commonStat: c,
+			targetPath: dest,
+			xattrIndex: fieldDisabled,
+		},
+	})
+}
+
+// Link creates a hard link at the given path to the existing, non-directory,
+// entry at target.
+func (b *Builder) Link(p, target string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !fs.ValidPath(target) {
+		return fs.ErrInvalid
+	}
+
+	t := b.root.getNode(target)
+	if t == nil {
+		return fs.ErrNotExist
+	} else if t.AsDir() != nil {
+		return fs.ErrInvalid
+	}
+
+	return b.addNode(p, &linkNode{
+		name:  path.Base(p),
+		entry: t.node(),
 	})
 }
 
@@ -252,16 +625,19 @@ func (b *Builder) Block(p string, deviceNumber uint32, options ...InodeOption) e
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if err := b.addNode(p, entry{
-		name: path.Base(p),
-	}); err != nil {
+	c, err := b.commonStat(p, options...)
+	if err != nil {
 		return err
 	}
 
-	return b.writeInode(blockStat{
-		commonStat:   b.commonStat(options...),
-		linkCount:    1,
-		deviceNumber: deviceNumber,
+	return b.addNode(p, &entry{
+		name: path.Base(p),
+		typ:  inodeBasicBlock,
+		stat: &blockStat{
+			commonStat:   c,
+			deviceNumber: deviceNumber,
+			xattrIndex:   fieldDisabled,
+		},
 	})
 }
 
@@ -269,122 +645,380 @@ func (b *Builder) Char(p string, deviceNumber uint32, options ...InodeOption) er
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if err := b.addNode(p, entry{
+	c, err := b.commonStat(p, options...)
+	if err != nil {
+		return err
+	}
+
+	return b.addNode(p, &entry{
 		name: path.Base(p),
-	}); err != nil {
+		typ:  inodeBasicChar,
+		stat: &charStat{
+			commonStat:   c,
+			deviceNumber: deviceNumber,
+			xattrIndex:   fieldDisabled,
+		},
+	})
+}
+
+func (b *Builder) FIFO(p string, options ...InodeOption) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, err := b.commonStat(p, options...)
+	if err != nil {
+		return err
+	}
+
+	return b.addNode(p, &entry{
+		name: path.Base(p),
+		typ:  inodeBasicPipe,
+		stat: &fifoStat{
+			commonStat: c,
+			xattrIndex: fieldDisabled,
+		},
+	})
+}
+
+func (b *Builder) Socket(p string, options ...InodeOption) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, err := b.commonStat(p, options...)
+	if err != nil {
+		return err
+	}
+
+	return b.addNode(p, &entry{
+		name: path.Base(p),
+		typ:  inodeBasicSock,
+		stat: &socketStat{
+			commonStat: c,
+			xattrIndex: fieldDisabled,
+		},
+	})
+}
+
+// Close writes any remaining data, the metadata tables and the superblock,
+// completing the image.
+//
+// Close must always be called, even after another method has returned an
+// error, as it stops any goroutines started by the CompressionWorkers option.
+func (b *Builder) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.blockWriter.stopWorkers()
+
+	if err := b.writeFragments(); err != nil {
+		return err
+	}
+
+	if err := b.blockWriter.Close(); err != nil {
+		return err
+	}
+
+	dirTable := newMetadataWriter(b.blockWriter.compressor)
+
+	if err := b.walkTree(&dirTable); err != nil {
+		return err
+	}
+
+	if err := b.inodeTable.Flush(); err != nil {
+		return err
+	}
+
+	if err := dirTable.Flush(); err != nil {
+		return err
+	}
+
+	if err := b.xattrTable.Flush(); err != nil {
 		return err
 	}
 
-	return b.writeInode(charStat{
-		commonStat:   b.commonStat(options...),
-		linkCount:    1,
-		deviceNumber: deviceNumber,
-	})
+	t := tableWriter{
+		w:   b.writer,
+		pos: b.blockWriter.Pos(),
+	}
+
+	t.WriteTable(&b.superblock.InodeTable, b.inodeTable.buf)
+	t.WriteTable(&b.superblock.DirTable, dirTable.buf)
+	t.WriteLookupTable(&b.superblock.FragTable, b.blockWriter.compressor, b.fragmentTable)
+	t.WriteLookupTable(&b.superblock.ExportTable, b.blockWriter.compressor, b.exportTable())
+	t.WriteLookupTable(&b.superblock.IDTable, b.blockWriter.compressor, b.idTable())
+	t.WriteXattrTable(&b.superblock.XattrTable, b.blockWriter.compressor, b.xattrTable.buf, b.xattrIDs)
+
+	b.superblock.IDCount = uint16(len(b.ids))
+
+	b.superblock.BytesUsed = uint64(t.pos)
+
+	if err := t.PadTo4K(); err != nil {
+		return err
+	}
+
+	if err := b.truncate(t.pos); err != nil {
+		return err
+	}
+
+	return b.writeSuperblock()
+}
+
+func (b *Builder) truncate(end int64) error {
+	if diff := end % padTo; diff != 0 {
+		end += padTo - diff
+	}
+
+	if t, ok := b.writer.(interface{ Truncate(int64) error }); ok && b.blockWriter.end > end {
+		return t.Truncate(end)
+	}
+
+	return nil
+}
+
+type tableWriter struct {
+	w   io.WriterAt
+	pos int64
+	err error
+}
+
+func (t *tableWriter) WriteTable(tablePos *uint64, p []byte) {
+	if t.err != nil {
+		return
+	}
+
+	if len(p) == 0 {
+		*tablePos = noTable
+
+		return
+	}
+
+	*tablePos = uint64(t.pos)
+
+	n, err := t.w.WriteAt(p, t.pos)
+
+	t.pos += int64(n)
+
+	if err != nil {
+		t.err = err
+	}
+}
+
+func (t *tableWriter) WriteLookupTable(tablePos *uint64, c CompressedWriter, data []byte) {
+	if t.err != nil {
+		return
+	}
+
+	if len(data) == 0 {
+		*tablePos = noTable
+
+		return
+	}
+
+	t.WriteTable(tablePos, t.writeLookupMetadata(c, data))
+}
+
+func (t *tableWriter) WriteXattrTable(tablePos *uint64, c CompressedWriter, kv, ids []byte) {
+	if t.err != nil {
+		return
+	}
+
+	if len(ids) == 0 {
+		*tablePos = noTable
+
+		return
+	}
+
+	var start uint64
+
+	t.WriteTable(&start, kv)
+
+	lookup := t.writeLookupMetadata(c, ids)
+	header := make(memio.Buffer, 0, xattrTableHeaderLength+len(lookup))
+	lew := byteio.LittleEndianWriter{Writer: &header}
+
+	lew.WriteUint64(start)
+	lew.WriteUint32(uint32(len(ids) / xattrIDLength))
+	lew.WriteUint32(0)
+	header.Write(lookup)
+
+	t.WriteTable(tablePos, header)
+}
+
+func (t *tableWriter) writeLookupMetadata(c CompressedWriter, data []byte) []byte {
+	var (
+		metadataPos uint64
+		lookup      memio.Buffer
+	)
+
+	m := newMetadataWriter(c)
+	lew := byteio.LittleEndianWriter{Writer: &lookup}
+	start := uint64(t.pos)
+
+	for len(data) > 0 {
+		lew.WriteUint64(start + uint64(len(m.buf)))
+
+		chunk := data[:min(len(data), blockSize)]
+		data = data[len(chunk):]
+
+		if _, err := m.Write(chunk); err != nil {
+			t.err = err
+
+			return nil
+		}
+	}
+
+	if err := m.Flush(); err != nil {
+		t.err = err
+
+		return nil
+	}
+
+	t.WriteTable(&metadataPos, m.buf)
+
+	return lookup
 }
 
-func (b *Builder) FIFO(p string, options ...InodeOption) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+func (t *tableWriter) PadTo4K() error {
+	if t.err != nil {
+		return t.err
+	}
 
-	if err := b.addNode(p, entry{
-		name: path.Base(p),
-	}); err != nil {
-		return err
+	diff := t.pos % padTo
+	if diff == 0 {
+		return nil
 	}
 
-	return b.writeInode(fifoStat{
-		commonStat: b.commonStat(options...),
-		linkCount:  1,
-	})
+	_, err := t.w.WriteAt(zeroPad[:], t.pos+padTo-diff-1)
+
+	return err
 }
 
-func (b *Builder) Socket(p string, options ...InodeOption) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+func (b *Builder) walkTree(dirTable *metadataWriter) error {
+	b.superblock.Inodes = 1
+	b.root.inode = 1
 
-	if err := b.addNode(p, entry{
-		name: path.Base(p),
-	}); err != nil {
+	if err := b.writeDir(dirTable, b.root, 0); err != nil {
 		return err
 	}
 
-	return b.writeInode(socketStat{
-		commonStat: b.commonStat(options...),
-		linkCount:  1,
-	})
+	b.superblock.RootInode = b.root.metadata
+
+	return nil
 }
 
-func (b *Builder) Close() error {
-	if err := b.writeFragments(); err != nil {
-		return err
+func (b *Builder) writeDir(dirTable *metadataWriter, d *dirNode, parent uint32) error {
+	for _, c := range d.children {
+		if e := c.node(); e.inode == 0 {
+			b.superblock.Inodes++
+			e.inode = b.superblock.Inodes
+		}
 	}
 
-	dirTable := newMetadataWriter(b.blockWriter.compressor)
+	linkCount := uint32(2)
 
-	b.walkTree(&dirTable)
+	for _, c := range d.children {
+		if cd := c.AsDir(); cd != nil {
+			linkCount++
 
-	t := tableWriter{
-		w:   b.writer,
-		pos: b.blockWriter.Pos(),
+			if err := b.writeDir(dirTable, cd, d.inode); err != nil {
+				return err
+			}
+		} else if e := c.node(); !e.written {
+			if err := b.writeInode(e); err != nil {
+				return err
+			}
+		}
 	}
 
-	t.WriteTable(&b.superblock.IDTable, b.idTable.buf)
-	t.WriteTable(&b.superblock.DirTable, dirTable.buf)
-	t.WriteTable(&b.superblock.FragTable, b.fragmentTable.buf)
-	t.WriteTable(&b.superblock.IDTable, b.idTable.buf)
+	if parent == 0 { // root dir's parent is set to one past the last inode
+		parent = b.superblock.Inodes + 1
+	}
 
-	if err := t.PadTo4K(); err != nil {
+	pos := uint64(dirTable.Pos())
+
+	size, index, err := writeDirEntries(dirTable, d.children)
+	if err != nil {
 		return err
 	}
 
-	return b.writeSuperblock()
-}
+	d.links = linkCount
+	d.stat = &dirStat{
+		commonStat:  d.commonStat,
+		blockIndex:  uint32(pos >> metadataPointerShift),
+		fileSize:    size + dirFileSizeOffset,
+		blockOffset: uint16(pos & metadataPointerMask),
+		parentInode: parent,
+		index:       index,
+		xattrIndex:  fieldDisabled,
+	}
 
-type tableWriter struct {
-	w   io.WriterAt
-	pos int64
-	err error
+	return b.writeInode(&d.entry)
 }
 
-func (t *tableWriter) WriteTable(tablePos *uint64, p []byte) {
-	if t.err != nil {
-		return
-	}
-
-	if len(p) == 0 {
-		*tablePos = noTable
+const (
+	maxDirEntries     = 256
+	minDirInodeOffset = -0x8000
+	maxDirInodeOffset = 0x7fff
+)
 
-		return
-	}
+// writeDirEntries writes the directory listing for the given children,
+// returning its size and an index entry for each header that starts in a
+// different metadata block to the one before it.
+func writeDirEntries(w *metadataWriter, children []childNode) (uint32, []dirIndex, error) {
+	var index []dirIndex
+
+	lew := byteio.StickyLittleEndianWriter{Writer: w}
+	block := w.Pos() >> metadataPointerShift
+
+	for len(children) > 0 {
+		count := dirHeaderCount(children)
+		first := children[0].node()
+
+		if start := w.Pos() >> metadataPointerShift; start != block {
+			block = start
+			index = append(index, dirIndex{
+				index: uint32(lew.Count),
+				start: uint32(start),
+				name:  children[0].Name(),
+			})
+		}
 
-	*tablePos = uint64(t.pos)
+		lew.WriteUint32(uint32(count - 1))
+		lew.WriteUint32(uint32(first.metadata >> metadataPointerShift))
+		lew.WriteUint32(first.inode)
 
-	n, err := t.w.WriteAt(p, t.pos)
+		for _, c := range children[:count] {
+			e := c.node()
 
-	t.pos += int64(n)
+			lew.WriteUint16(uint16(e.metadata & metadataPointerMask))
+			lew.WriteInt16(int16(int64(e.inode) - int64(first.inode)))
+			lew.WriteUint16(e.typ)
+			lew.WriteUint16(uint16(len(c.Name()) - 1))
+			lew.WriteString(c.Name())
+		}
 
-	if err != nil {
-		t.err = err
+		children = children[count:]
 	}
+
+	return uint32(lew.Count), index, lew.Err
 }
 
-func (t *tableWriter) PadTo4K() error {
-	if t.err != nil {
-		return t.err
-	}
+func dirHeaderCount(children []childNode) int {
+	first := children[0].node()
+	start := first.metadata >> metadataPointerShift
 
-	diff := t.pos % padTo
-	if diff == 0 {
-		return nil
-	}
+	for n, c := range children {
+		e := c.node()
 
-	_, err := t.w.WriteAt(zeroPad[:], t.pos+diff)
+		if n == maxDirEntries || e.metadata>>metadataPointerShift != start {
+			return n
+		}
 
-	return err
-}
+		if offset := int64(e.inode) - int64(first.inode); offset < minDirInodeOffset || offset > maxDirInodeOffset {
+			return n
+		}
+	}
 
-func (b *Builder) walkTree(_dirTable *metadataWriter) error {
-	return nil
+	return len(children)
 }
 
 func (b *Builder) writeSuperblock() error {
@@ -402,26 +1036,43 @@ func (b *Builder) writeSuperblock() error {
 type childNode interface {
 	Name() string
 	AsDir() *dirNode
+	node() *entry
 }
 
 type entry struct {
 	name     string
-	metadata uint32
+	metadata uint64
+	inode    uint32
+	links    uint32
 	typ      uint16
+	written  bool
+	stat     inodeWriter
 }
 
-func (e entry) Name() string {
+func (e *entry) Name() string {
 	return e.name
 }
 
-func (e entry) AsDir() *dirNode {
+func (e *entry) AsDir() *dirNode {
 	return nil
 }
 
+func (e *entry) node() *entry {
+	return e
+}
+
+type linkNode struct {
+	name string
+	*entry
+}
+
+func (l *linkNode) Name() string {
+	return l.name
+}
+
 type dirNode struct {
 	entry
 	commonStat commonStat
-	inode      uint64
 	children   []childNode
 }
 
@@ -436,11 +1087,7 @@ func (b *Builder) getParent(n *dirNode, path string) *dirNode {
 		return n
 	}
 
-	p := n.insertSortedNode(&dirNode{
-		entry: entry{
-			name: first,
-		},
-	})
+	p := n.insertSortedNode(b.newDirNode(first, b.defaultStat))
 
 	d := p.AsDir()
 
@@ -469,6 +1116,43 @@ func (d *dirNode) insertSortedNode(i childNode) childNode {
 	return i
 }
 
+func (d *dirNode) find(name string) (int, bool) {
+	return slices.BinarySearchFunc(d.children, name, func(a childNode, name string) int {
+		return strings.Compare(a.Name(), name)
+	})
+}
+
+func (d *dirNode) getNode(p string) childNode {
+	name, rest, more := strings.Cut(p, "/")
+
+	pos, exists := d.find(name)
+	if !exists {
+		return nil
+	} else if !more {
+		return d.children[pos]
+	} else if cd := d.children[pos].AsDir(); cd != nil {
+		return cd.getNode(rest)
+	}
+
+	return nil
+}
+
+func (d *dirNode) removeNode(pos int) {
+	unlinkNode(d.children[pos])
+
+	d.children = slices.Delete(d.children, pos, pos+1)
+}
+
+func unlinkNode(c childNode) {
+	if d := c.AsDir(); d != nil {
+		for _, c := range d.children {
+			unlinkNode(c)
+		}
+	} else {
+		c.node().links--
+	}
+}
+
 func splitPath(path string) (string, string) {
 	pos := strings.IndexByte(path, '/')
 	if pos == -1 {
@@ -480,21 +1164,52 @@ func splitPath(path string) (string, string) {
 
 type blockWriter struct {
 	w            *io.OffsetWriter
+	end          int64
+	uncompressed memio.LimitedBuffer
+	compressor   CompressedWriter
+	jobs         chan *blockJob
+	pending      []*blockJob
+	free         []*blockJob
+	window       int
+}
+
+type blockJob struct {
 	uncompressed memio.LimitedBuffer
 	compressed   memio.LimitedBuffer
-	compressor   compressedWriter
+	out          []byte
+	done         chan struct{}
+	written      func(pos int64, size uint32) error
 }
 
-func newBlockWriter(w io.WriterAt, start int64, blockSize uint32, compressor compressedWriter) blockWriter {
+func newBlockWriter(w io.WriterAt, start int64, blockSize uint32, compressor CompressedWriter, workers []CompressedWriter) blockWriter {
 	ow := io.NewOffsetWriter(w, 0)
 
 	ow.Seek(start, io.SeekStart)
 
-	return blockWriter{
+	b := blockWriter{
 		w:            ow,
 		uncompressed: make(memio.LimitedBuffer, blockSize),
-		compressed:   make(memio.LimitedBuffer, 0, blockSize),
 		compressor:   compressor,
+		window:       1,
+	}
+
+	if len(workers) > 0 {
+		b.jobs = make(chan *blockJob, len(workers))
+		b.window = 2 * len(workers)
+
+		for _, c := range workers {
+			go compressBlocks(c, b.jobs)
+		}
+	}
+
+	return b
+}
+
+func compressBlocks(c CompressedWriter, jobs chan *blockJob) {
+	for j := range jobs {
+		j.out = compressIfSmaller(c, j.compressed, j.uncompressed)
+
+		close(j.done)
 	}
 }
 
@@ -504,49 +1219,334 @@ func (b *blockWriter) Pos() int64 {
 	return pos
 }
 
-func (b *blockWriter) WriteFile(r io.Reader) ([]uint32, error) {
-	var sizes []uint32
+func (b *blockWriter) Rewind(pos int64) {
+	b.end = max(b.end, b.Pos())
+
+	b.w.Seek(pos, io.SeekStart)
+}
+
+func (b *blockWriter) WriteFile(f *fileStat, r io.Reader, h hash.Hash) error {
+	sr, _ := r.(SparseReader)
+
+	var (
+		holes   []Hole
+		started bool
+	)
+
+	if sr != nil {
+		holes = sr.Holes()
+	}
 
 	for {
-		if _, err := io.ReadFull(r, b.uncompressed); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
-			return sizes, nil
+		if holes = skipHoles(holes, int64(f.fileSize)); isHole(holes, int64(f.fileSize), int64(len(b.uncompressed))) {
+			if _, err := sr.Seek(int64(len(b.uncompressed)), io.SeekCurrent); err != nil {
+				return err
+			}
+
+			f.addHole(uint64(len(b.uncompressed)))
+			hashBlock(h, nil)
+
+			continue
+		}
+
+		n, err := io.ReadFull(r, b.uncompressed)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			f.fileSize += uint64(n)
+
+			if started {
+				return b.Flush()
+			}
+
+			return nil
 		} else if err != nil {
-			return nil, err
+			return err
 		}
 
-		n, err := b.w.Write(b.compressIfSmaller(b.uncompressed))
-		if err != nil {
-			return nil, err
+		if isZero(b.uncompressed) {
+			f.addHole(uint64(n))
+			hashBlock(h, nil)
+
+			continue
+		}
+
+		hashBlock(h, b.uncompressed)
+
+		block := len(f.blockSizes)
+		first := !started
+		started = true
+
+		f.fileSize += uint64(n)
+		f.blockSizes = append(f.blockSizes, 0)
+
+		if err := b.queue(b.uncompressed, f.blockWritten(block, first)); err != nil {
+			return err
+		}
+	}
+}
+
+// CopyFile copies the compressed data blocks of the src file, which must have
+// been written with the same block size and compressor, without
+// decompressing them.
+func (b *blockWriter) CopyFile(f *fileStat, src *file, h hash.Hash) error {
+	pos := int64(src.file.blocksStart)
+	started := false
+
+	for block, size := range src.file.blockSizes {
+		length := src.blockLength(block)
+		if length <= 0 || size&sizeMask > uint32(len(b.uncompressed)) {
+			return ErrInvalidBlockHeader
+		}
+
+		if size&sizeMask == 0 {
+			f.addHole(uint64(length))
+			hashBlock(h, nil)
+
+			continue
+		}
+
+		data := b.uncompressed[:size&sizeMask]
+
+		if _, err := src.squashfs.reader.ReadAt(data, pos); err != nil {
+			return err
+		}
+
+		pos += int64(len(data))
+
+		hashCompressedBlock(h, size, data)
+
+		first := !started
+		started = true
+
+		f.fileSize += uint64(length)
+		f.blockSizes = append(f.blockSizes, 0)
+
+		if err := b.queueCompressed(data, size&compressionMask == 0, f.blockWritten(len(f.blockSizes)-1, first)); err != nil {
+			return err
+		}
+	}
+
+	if started {
+		return b.Flush()
+	}
+
+	return nil
+}
+
+func (f *fileStat) blockWritten(block int, first bool) func(int64, uint32) error {
+	return func(pos int64, size uint32) error {
+		if first {
+			f.blocksStart = uint64(pos)
+		}
+
+		f.blockSizes[block] = size
+
+		return nil
+	}
+}
+
+var (
+	hashHole       = []byte{0}
+	hashData       = []byte{1}
+	hashCompressed = []byte{2}
+)
+
+func hashBlock(h hash.Hash, data []byte) {
+	if h == nil {
+		return
+	} else if data == nil {
+		h.Write(hashHole)
+	} else {
+		h.Write(hashData)
+		h.Write(data)
+	}
+}
+
+func hashCompressedBlock(h hash.Hash, size uint32, data []byte) {
+	if h == nil {
+		return
+	} else if size&compressionMask != 0 {
+		hashBlock(h, data)
+	} else {
+		h.Write(hashCompressed)
+		h.Write(data)
+	}
+}
+
+func skipHoles(holes []Hole, pos int64) []Hole {
+	for len(holes) > 0 && holes[0].Offset+holes[0].Length <= pos {
+		holes = holes[1:]
+	}
+
+	return holes
+}
+
+func isHole(holes []Hole, pos, length int64) bool {
+	return len(holes) > 0 && holes[0].Offset <= pos && holes[0].Offset+holes[0].Length >= pos+length
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *blockWriter) WriteFragments(fragments []byte, written func(pos int64, size uint32) error) error {
+	return b.queue(fragments, written)
+}
+
+func (b *blockWriter) queue(data []byte, written func(pos int64, size uint32) error) error {
+	if len(b.pending) == b.window {
+		if err := b.writeNext(); err != nil {
+			return err
+		}
+	}
+
+	j := b.newJob()
+	j.uncompressed = append(j.uncompressed, data...)
+	j.written = written
+	b.pending = append(b.pending, j)
+
+	if b.jobs == nil {
+		j.out = compressIfSmaller(b.compressor, j.compressed, j.uncompressed)
+
+		return b.writeNext()
+	}
+
+	j.done = make(chan struct{})
+	b.jobs <- j
+
+	return nil
+}
+
+// queueCompressed queues data that has already been compressed, or was stored
+// uncompressed, to be written without passing through the compressor.
+func (b *blockWriter) queueCompressed(data []byte, compressed bool, written func(pos int64, size uint32) error) error {
+	if len(b.pending) == b.window {
+		if err := b.writeNext(); err != nil {
+			return err
 		}
+	}
+
+	j := b.newJob()
+	j.written = written
+
+	if compressed {
+		j.compressed = append(j.compressed, data...)
+		j.out = j.compressed
+	} else {
+		j.uncompressed = append(j.uncompressed, data...)
+		j.out = j.uncompressed
+	}
+
+	b.pending = append(b.pending, j)
+
+	if b.jobs == nil {
+		return b.writeNext()
+	}
+
+	return nil
+}
+
+func (b *blockWriter) newJob() *blockJob {
+	if l := len(b.free); l > 0 {
+		j := b.free[l-1]
+		b.free = b.free[:l-1]
+
+		return j
+	}
+
+	return &blockJob{
+		uncompressed: make(memio.LimitedBuffer, 0, len(b.uncompressed)),
+		compressed:   make(memio.LimitedBuffer, 0, len(b.uncompressed)),
+	}
+}
 
-		sizes = append(sizes, uint32(n))
+func (b *blockWriter) writeNext() error {
+	j := b.pending[0]
+	b.pending = append(b.pending[:0], b.pending[1:]...)
+
+	if j.done != nil {
+		<-j.done
+	}
+
+	pos := b.Pos()
+
+	n, err := b.w.Write(j.out)
+	if err != nil {
+		return err
+	}
+
+	size := uint32(n)
+
+	if len(j.uncompressed) > 0 && &j.out[0] == &j.uncompressed[0] {
+		size |= compressionMask
+	}
+
+	j.uncompressed = j.uncompressed[:0]
+	j.compressed = j.compressed[:0]
+	b.free = append(b.free, j)
+
+	return j.written(pos, size)
+}
+
+func (b *blockWriter) Flush() error {
+	for len(b.pending) > 0 {
+		if err := b.writeNext(); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+func (b *blockWriter) Close() error {
+	err := b.Flush()
+
+	b.stopWorkers()
+
+	return err
 }
 
-func (b *blockWriter) WriteFragments(fragments []byte) (int, error) {
-	return b.w.Write(b.compressIfSmaller(fragments))
+func (b *blockWriter) stopWorkers() {
+	if b.jobs != nil {
+		close(b.jobs)
+
+		b.jobs = nil
+	}
 }
 
-func (b *blockWriter) compressIfSmaller(data []byte) []byte {
-	c := b.compressed
+func compressIfSmaller(c CompressedWriter, buf memio.LimitedBuffer, data []byte) []byte {
+	if len(data) < 2 {
+		return data
+	}
+
+	out := buf[:0:min(cap(buf), len(data)-1)]
 
-	b.compressor.Reset(&c)
+	c.Reset(&out)
+
+	if _, err := c.Write(data); err != nil {
+		return data
+	}
 
-	if _, err := b.compressor.Write(data); !errors.Is(err, io.ErrShortWrite) {
-		return c
+	if err := c.Close(); err != nil {
+		return data
 	}
 
-	return data
+	return out
 }
 
 type metadataWriter struct {
 	buf          memio.Buffer
 	uncompressed memio.LimitedBuffer
 	compressed   memio.LimitedBuffer
-	compressor   compressedWriter
+	compressor   CompressedWriter
 }
 
-func newMetadataWriter(compressor compressedWriter) metadataWriter {
+func newMetadataWriter(compressor CompressedWriter) metadataWriter {
 	return metadataWriter{
 		uncompressed: make(memio.LimitedBuffer, 0, blockSize),
 		compressed:   make(memio.LimitedBuffer, 0, blockSize),
@@ -605,14 +1605,6 @@ func (m *metadataWriter) Flush() error {
 	return nil
 }
 
-func (m *metadataWriter) compressedOrUncompressed() memio.LimitedBuffer {
-	c := m.compressed
-
-	m.compressor.Reset(&c)
-
-	if _, err := m.compressor.Write(m.uncompressed); !errors.Is(err, io.ErrShortWrite) {
-		return c
-	}
-
-	return m.uncompressed
+func (m *metadataWriter) compressedOrUncompressed() []byte {
+	return compressIfSmaller(m.compressor, m.compressed, m.uncompressed)
 }
@@ -0,0 +1,2124 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"vimagination.zapto.org/byteio"
+)
+
+type buildFn func(*Builder) error
+
+func buildAndOpen(t *testing.T, build buildFn, options ...BuildOption) *SquashFS {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.sqfs"))
+	if err != nil {
+		t.Fatalf("unexpected error creating squashfs file: %s", err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+
+	b, err := Create(f, options...)
+	if err != nil {
+		t.Fatalf("unexpected error creating builder: %s", err)
+	}
+
+	if err = build(b); err != nil {
+		t.Fatalf("unexpected error building squashfs: %s", err)
+	}
+
+	if err = b.Close(); err != nil {
+		t.Fatalf("unexpected error closing builder: %s", err)
+	}
+
+	sfs, err := Open(f)
+	if err != nil {
+		t.Fatalf("unexpected error opening squashfs reader: %s", err)
+	}
+
+	return sfs
+}
+
+func TestBuilderDirTable(t *testing.T) {
+	const numEntries = 300
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		for n := range numEntries {
+			if err := b.Dir(fmt.Sprintf("dirA/dir%03d", n)); err != nil {
+				return err
+			}
+		}
+
+		return b.Symlink("dirB/link", "../dirA")
+	})
+
+	root, err := readDirInode(sfs, sfs.superblock.RootInode)
+	if err != nil {
+		t.Fatalf("unexpected error reading root inode: %s", err)
+	} else if root.parentInode != sfs.superblock.Inodes+1 {
+		t.Errorf("expecting root parent inode %d, got %d", sfs.superblock.Inodes+1, root.parentInode)
+	} else if root.linkCount != 4 {
+		t.Errorf("expecting root link count 4, got %d", root.linkCount)
+	}
+
+	entries, err := readDirEntries(sfs, root)
+	if err != nil {
+		t.Fatalf("unexpected error reading root dir: %s", err)
+	} else if len(entries) != 2 || entries[0].name != "dirA" || entries[1].name != "dirB" {
+		t.Fatalf("expecting entries dirA and dirB, got %v", entries)
+	}
+
+	dirA, err := readDirInode(sfs, entries[0].ptr)
+	if err != nil {
+		t.Fatalf("unexpected error reading dirA inode: %s", err)
+	} else if dirA.parentInode != root.inode {
+		t.Errorf("expecting dirA parent inode %d, got %d", root.inode, dirA.parentInode)
+	} else if dirA.linkCount != numEntries+2 {
+		t.Errorf("expecting dirA link count %d, got %d", numEntries+2, dirA.linkCount)
+	}
+
+	if entries, err = readDirEntries(sfs, dirA); err != nil {
+		t.Fatalf("unexpected error reading dirA: %s", err)
+	} else if len(entries) != numEntries {
+		t.Fatalf("expecting %d entries, got %d", numEntries, len(entries))
+	}
+
+	for n, entry := range entries {
+		if name := fmt.Sprintf("dir%03d", n); entry.name != name {
+			t.Errorf("test %d: expecting name %q, got %q", n+1, name, entry.name)
+		} else if ds, err := readDirInode(sfs, entry.ptr); err != nil {
+			t.Errorf("test %d: unexpected error reading inode: %s", n+1, err)
+		} else if ds.parentInode != dirA.inode {
+			t.Errorf("test %d: expecting parent inode %d, got %d", n+1, dirA.inode, ds.parentInode)
+		}
+	}
+}
+
+// readDirInode reads a directory inode without resolving its uid and gid.
+func readDirInode(sfs *SquashFS, ptr uint64) (dirStat, error) {
+	r, err := sfs.readMetadata(ptr, sfs.superblock.InodeTable)
+	if err != nil {
+		return dirStat{}, err
+	}
+
+	ler := byteio.StickyLittleEndianReader{Reader: r}
+	typ := ler.ReadUint16()
+
+	ler.ReadUint16() // perms
+	ler.ReadUint16() // uid
+	ler.ReadUint16() // gid
+	ler.ReadUint32() // mtime
+
+	ds, ok := sfs.readEntry(&ler, typ, commonStat{inode: ler.ReadUint32()}).(dirStat)
+	if ler.Err != nil {
+		return dirStat{}, ler.Err
+	} else if !ok {
+		return dirStat{}, fs.ErrInvalid
+	}
+
+	return ds, nil
+}
+
+func readDirEntries(sfs *SquashFS, ds dirStat) ([]dirEntry, error) {
+	d, err := sfs.newDir(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	des, err := d.readDir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dirEntry, len(des))
+
+	for n, de := range des {
+		entries[n] = de.(dirEntry)
+	}
+
+	return entries, nil
+}
+
+func TestBuilder(t *testing.T) {
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		for _, file := range [...]struct {
+			path, contents string
+		}{
+			{"fileA", contentsA},
+			{"dirA/fileB", contentsB},
+			{"dirA/fileC", contentsC},
+			{"dirA/dirB/fileD", contentsD},
+			{"dirA/dirB/fileE", contentsE},
+		} {
+			if err := b.File(file.path, strings.NewReader(file.contents)); err != nil {
+				return err
+			}
+		}
+
+		return b.Dir("dirC", Mode(0o700))
+	})
+
+	if err := fstest.TestFS(sfs, "fileA", "dirA/fileB", "dirA/fileC", "dirA/dirB/fileD", "dirA/dirB/fileE", "dirC"); err != nil {
+		t.Fatal(err)
+	}
+
+	for n, test := range [...]struct {
+		path, contents string
+	}{
+		{"fileA", contentsA},
+		{"dirA/fileB", contentsB},
+		{"dirA/fileC", contentsC},
+		{"dirA/dirB/fileD", contentsD},
+		{"dirA/dirB/fileE", contentsE},
+	} {
+		if err := readSqfsFile(sfs, test.path, test.contents); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+}
+
+func TestBuilderSymlink(t *testing.T) {
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("dirA/fileA", strings.NewReader(contentsD)); err != nil {
+			return err
+		}
+
+		return b.Symlink("dirB/symB", "../dirA/fileA")
+	})
+
+	if err := readSqfsFile(sfs, "dirB/symB", contentsD); err != nil {
+		t.Fatal(err)
+	}
+
+	if sym, err := sfs.ReadLink("dirB/symB"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if sym != "../dirA/fileA" {
+		t.Fatalf("expecting symlink dest %q, got %q", "../dirA/fileA", sym)
+	}
+}
+
+func TestBuilderLargeDir(t *testing.T) {
+	const numEntries = 1000
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		for n := range numEntries {
+			if err := b.File(fmt.Sprintf("dir/%s%d", strings.Repeat("a", n%100), n), strings.NewReader(contentsA)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	entries, err := sfs.ReadDir("dir")
+	if err != nil {
+		t.Fatalf("unexpected error reading dir: %s", err)
+	} else if len(entries) != numEntries {
+		t.Fatalf("expecting %d entries, got %d", numEntries, len(entries))
+	}
+
+	for n, entry := range entries {
+		if err := readSqfsFile(sfs, "dir/"+entry.Name(), contentsA); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+
+	if fi, err := sfs.Stat("dir"); err != nil {
+		t.Fatalf("unexpected error stating dir: %s", err)
+	} else if d, ok := fi.(dirStat); !ok {
+		t.Fatalf("expecting dirStat, got %T", fi)
+	} else if len(d.index) == 0 {
+		t.Fatal("expecting directory index entries")
+	}
+
+	for n, name := range [...]string{"00", "a", "aaaa", "b"} {
+		if _, err := sfs.Stat("dir/" + name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("test %d: expecting error %s, got %s", n+1, fs.ErrNotExist, err)
+		}
+	}
+}
+
+func TestBuilderOwners(t *testing.T) {
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("fileA", strings.NewReader(contentsA), Owner(1000, 1000)); err != nil {
+			return err
+		}
+
+		if err := b.File("fileB", strings.NewReader(contentsA), Owner(65534, 0)); err != nil {
+			return err
+		}
+
+		return b.Dir("dirA", Owner(123, 65534))
+	}, DefaultOwner(1000, 100))
+
+	for n, test := range [...]struct {
+		path     string
+		uid, gid uint32
+	}{
+		{".", 1000, 100},
+		{"fileA", 1000, 1000},
+		{"fileB", 65534, 0},
+		{"dirA", 123, 65534},
+	} {
+		fi, err := sfs.Stat(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		var c commonStat
+
+		switch fi := fi.(type) {
+		case fileStat:
+			c = fi.commonStat
+		case dirStat:
+			c = fi.commonStat
+		}
+
+		if c.uid != test.uid || c.gid != test.gid {
+			t.Errorf("test %d: expecting uid %d and gid %d, got %d and %d", n+1, test.uid, test.gid, c.uid, c.gid)
+		}
+	}
+
+	if sfs.superblock.IDCount != 5 {
+		t.Errorf("expecting 5 ids, got %d", sfs.superblock.IDCount)
+	}
+}
+
+func TestBuilderFragments(t *testing.T) {
+	const numFiles = 1 << 10
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		for n := range numFiles {
+			if err := b.File(fmt.Sprintf("file%d", n), strings.NewReader(fmt.Sprintf("%s%d", contentsB[:n], n))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, BlockSize4K)
+
+	if sfs.superblock.FragCount < 2 {
+		t.Fatalf("expecting multiple fragment blocks, got %d", sfs.superblock.FragCount)
+	}
+
+	for n := range numFiles {
+		if err := readSqfsFile(sfs, fmt.Sprintf("file%d", n), fmt.Sprintf("%s%d", contentsB[:n], n)); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+}
+
+func TestBuilderExportTable(t *testing.T) {
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		return b.File("dirA/fileA", strings.NewReader(contentsA))
+	}, ExportTable())
+
+	if sfs.superblock.ExportTable == noTable {
+		t.Fatal("expecting export table to be written")
+	}
+
+	fi, err := fs.Stat(sfs, "dirA/fileA")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	inode := fi.Sys().(fileStat).inode
+
+	if fi, err = sfs.StatInode(inode); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if st, ok := fi.(fileStat); !ok || st.inode != inode || st.fileSize != uint64(len(contentsA)) {
+		t.Fatalf("expecting file with inode %d, got %v", inode, fi)
+	}
+
+	if fi, err = sfs.StatInode(1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !fi.IsDir() {
+		t.Fatal("expecting inode 1 to be a directory")
+	}
+
+	f, err := sfs.OpenInode(inode)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer f.Close()
+
+	if data, err := io.ReadAll(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(data) != contentsA {
+		t.Fatalf("expecting to read %q, got %q", contentsA, data)
+	}
+
+	for _, inode := range [...]uint32{0, 4} {
+		if _, err = sfs.StatInode(inode); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("inode %d: expecting error ErrNotExist, got %v", inode, err)
+		}
+	}
+
+	sfs = buildAndOpen(t, func(b *Builder) error {
+		return b.File("dirA/fileA", strings.NewReader(contentsA))
+	})
+
+	if _, err = sfs.OpenInode(inode); !errors.Is(err, ErrNoExportTable) {
+		t.Errorf("expecting error ErrNoExportTable, got %v", err)
+	}
+}
+
+func TestBuilderCompression(t *testing.T) {
+	tests := [...]CompressorOptions{
+		DefaultGzipOptions(),
+		&GZipOptions{CompressionLevel: 1, WindowSize: maximumWindowSize},
+		DefaultZStdOptions(),
+		&ZStdOptions{CompressionLevel: 1},
+		&ZStdOptions{CompressionLevel: maxZStdCompressionLevel},
+		DefaultXZOptions(),
+		&XZOptions{DictionarySize: 1 << 17, Filters: maxFilters},
+		DefaultLZ4Options(),
+		&LZ4Options{Version: lz4Version, Flags: lz4FlagHC},
+		DefaultLZOOptions(),
+		&LZOOptions{Algorithm: lzoAlgorithm1X1},
+		&LZOOptions{Algorithm: lzoAlgorithm1X999, CompressionLevel: 1},
+	}
+
+	files := map[string]string{
+		"fileA":      contentsA,
+		"dirA/fileB": contentsB,
+		"dirA/fileE": contentsE,
+	}
+
+	images := make([]string, len(tests))
+
+	for n, test := range tests {
+		sfs := buildAndOpen(t, func(b *Builder) error {
+			if err := b.File("fileA", strings.NewReader(contentsA)); err != nil {
+				return err
+			}
+
+			if err := b.File("dirA/fileB", strings.NewReader(contentsB)); err != nil {
+				return err
+			}
+
+			return b.File("dirA/fileE", strings.NewReader(contentsE))
+		}, Compression(test))
+
+		images[n] = sfs.reader.(*os.File).Name()
+
+		if c := sfs.superblock.Compressor; c != test.AsCompressor() {
+			t.Errorf("test %d: expecting compressor %s, got %s", n+1, test.AsCompressor(), c)
+
+			continue
+		}
+
+		if err := fstest.TestFS(sfs, "fileA", "dirA/fileB", "dirA/fileE"); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+
+	checkUnsquashfs(t)
+
+	for n, image := range images {
+		if err := unsquashfs(image, filepath.Join(t.TempDir(), "out"), files); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+}
+
+// unsquashfs extracts the image with the unsquashfs tool, and checks the
+// contents of the extracted files.
+func unsquashfs(image, dir string, files map[string]string) error {
+	if output, err := exec.Command("unsquashfs", "-no-progress", "-d", dir, image).CombinedOutput(); err != nil {
+		return fmt.Errorf("unexpected error running unsquashfs: %w: %s", err, output)
+	}
+
+	for name, contents := range files {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("unexpected error reading unsquashfs output: %w", err)
+		} else if string(data) != contents {
+			return fmt.Errorf("unsquashfs output for %s does not match", name)
+		}
+	}
+
+	return nil
+}
+
+func TestBuilderXattrs(t *testing.T) {
+	long := strings.Repeat("a long value ", 10)
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("fileA", strings.NewReader(contentsA), Xattr("user.comment", []byte("A")), Xattr("security.selinux", []byte(long))); err != nil {
+			return err
+		}
+
+		if err := b.File("fileB", strings.NewReader(contentsB), Xattr("security.selinux", []byte(long)), Xattr("user.comment", []byte("B")), Xattr("user.comment", []byte("A"))); err != nil {
+			return err
+		}
+
+		if err := b.File("fileC", strings.NewReader(contentsC), Xattr("trusted.other", []byte(long))); err != nil {
+			return err
+		}
+
+		if err := b.File("fileD", strings.NewReader(contentsD)); err != nil {
+			return err
+		}
+
+		if err := b.Symlink("link", "fileC", Xattr("user.link", []byte("symlink"))); err != nil {
+			return err
+		}
+
+		return b.Dir("dirA", Xattr("user.comment", []byte("a directory")))
+	})
+
+	if sfs.superblock.XattrTable == noTable {
+		t.Fatal("expecting xattr table to be written")
+	}
+
+	for n, test := range [...]struct {
+		path, name string
+		follow     bool
+		value      string
+		err        error
+	}{
+		{"fileA", "user.comment", true, "A", nil},
+		{"fileA", "security.selinux", true, long, nil},
+		{"fileB", "user.comment", true, "A", nil},
+		{"fileB", "security.selinux", true, long, nil},
+		{"fileC", "trusted.other", true, long, nil},
+		{"fileC", "user.comment", true, "", ErrNoXattr},
+		{"fileD", "user.comment", true, "", ErrNoXattr},
+		{"link", "user.link", false, "symlink", nil},
+		{"link", "trusted.other", true, long, nil},
+		{"dirA", "user.comment", true, "a directory", nil},
+	} {
+		var (
+			value []byte
+			err   error
+		)
+
+		if test.follow {
+			value, err = sfs.GetXattr(test.path, test.name)
+		} else {
+			value, err = sfs.LGetXattr(test.path, test.name)
+		}
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.err, err)
+		} else if string(value) != test.value {
+			t.Errorf("test %d: expecting value %q, got %q", n+1, test.value, value)
+		}
+	}
+
+	for n, test := range [...]struct {
+		path string
+		keys []string
+	}{
+		{"fileA", []string{"security.selinux", "user.comment"}},
+		{"fileB", []string{"security.selinux", "user.comment"}},
+		{"fileC", []string{"trusted.other"}},
+		{"fileD", nil},
+		{"dirA", []string{"user.comment"}},
+	} {
+		if keys, err := sfs.ListXattr(test.path); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !slices.Equal(keys, test.keys) {
+			t.Errorf("test %d: expecting keys %v, got %v", n+1, test.keys, keys)
+		}
+	}
+
+	fileA, err := sfs.Stat("fileA")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fileB, err := sfs.Stat("fileB")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if a, b := xattrIndex(fileA), xattrIndex(fileB); a != b {
+		t.Errorf("expecting identical xattr sets to share an index, got %d and %d", a, b)
+	}
+
+	f, err := sfs.Open("dirA")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer f.Close()
+
+	if value, err := f.(*dir).GetXattr("user.comment"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(value) != "a directory" {
+		t.Errorf("expecting value %q, got %q", "a directory", value)
+	}
+}
+
+func TestBuilderInvalidXattr(t *testing.T) {
+	value := []byte("value")
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		for n, test := range [...]struct {
+			name  string
+			value []byte
+			add   func(string, ...InodeOption) error
+		}{
+			{"comment", nil, func(p string, options ...InodeOption) error {
+				return b.File(p, strings.NewReader(contentsA), options...)
+			}},
+			{"user.", nil, b.Dir},
+			{"system.posix_acl_access", nil, func(p string, options ...InodeOption) error {
+				return b.Symlink(p, "file", options...)
+			}},
+			{"user.large", make([]byte, maxXattrValueLength+1), b.FIFO},
+		} {
+			var pe *fs.PathError
+
+			if err := test.add("bad", Xattr(test.name, test.value)); !errors.Is(err, ErrInvalidXattr) {
+				return fmt.Errorf("test %d: expecting error ErrInvalidXattr, got %v", n+1, err)
+			} else if !errors.As(err, &pe) || pe.Path != "bad" {
+				return fmt.Errorf("test %d: expecting path error for %q, got %v", n+1, "bad", err)
+			}
+		}
+
+		if err := b.File("file", strings.NewReader(contentsA), Xattr("user.attr", value)); err != nil {
+			return err
+		}
+
+		copy(value, "VALUE")
+
+		return nil
+	})
+
+	if _, err := sfs.Stat("bad"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expecting error ErrNotExist, got %v", err)
+	}
+
+	if v, err := sfs.GetXattr("file", "user.attr"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(v) != "value" {
+		t.Errorf("expecting xattr value %q, got %q", "value", v)
+	}
+}
+
+func TestBuilderLinks(t *testing.T) {
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("dirA/fileA", strings.NewReader(contentsA)); err != nil {
+			return err
+		}
+
+		if err := b.Symlink("dirA/symlinkA", "fileA"); err != nil {
+			return err
+		}
+
+		if err := b.Link("dirB/linkA", "dirA/fileA"); err != nil {
+			return err
+		}
+
+		if err := b.Link("dirA/dirC/linkB", "dirB/linkA"); err != nil {
+			return err
+		}
+
+		if err := b.Link("dirA/linkC", "dirA/symlinkA"); err != nil {
+			return err
+		}
+
+		if err := b.Link("linkD", "dirA/missing"); !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("expecting error ErrNotExist, got %v", err)
+		}
+
+		if err := b.Link("linkD", "dirA"); !errors.Is(err, fs.ErrInvalid) {
+			return fmt.Errorf("expecting error ErrInvalid, got %v", err)
+		}
+
+		if err := b.Link("dirB/linkA", "dirA/symlinkA"); !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("expecting error ErrExist, got %v", err)
+		}
+
+		return b.File("fileB", strings.NewReader(contentsB))
+	})
+
+	for n, path := range [...]string{"dirA/fileA", "dirA/symlinkA", "dirB/linkA", "dirA/dirC/linkB", "dirA/linkC"} {
+		if err := readSqfsFile(sfs, path, contentsA); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+
+	for n, test := range [...]struct {
+		path      string
+		inode     uint32
+		linkCount uint32
+	}{
+		{".", 1, 4},
+		{"dirA", 2, 3},
+		{"dirB", 3, 2},
+		{"dirA/dirC", 5, 2},
+		{"dirA/fileA", 6, 3},
+		{"dirA/symlinkA", 7, 2},
+		{"dirB/linkA", 6, 3},
+		{"dirA/dirC/linkB", 6, 3},
+		{"dirA/linkC", 7, 2},
+		{"fileB", 4, 1},
+	} {
+		fi, err := sfs.LStat(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		var inode, linkCount uint32
+
+		switch fi := fi.(type) {
+		case dirStat:
+			inode, linkCount = fi.inode, fi.linkCount
+		case fileStat:
+			inode, linkCount = fi.inode, fi.linkCount
+		case symlinkStat:
+			inode, linkCount = fi.inode, fi.linkCount
+		}
+
+		if inode != test.inode {
+			t.Errorf("test %d: expecting inode %d, got %d", n+1, test.inode, inode)
+		} else if linkCount != test.linkCount {
+			t.Errorf("test %d: expecting link count %d, got %d", n+1, test.linkCount, linkCount)
+		}
+	}
+}
+
+type sparseReader struct {
+	*strings.Reader
+	holes []Hole
+}
+
+func (s sparseReader) Holes() []Hole {
+	return s.holes
+}
+
+func TestBuilderSparse(t *testing.T) {
+	const block = 1 << 12
+
+	zeros := strings.Repeat("\x00", block)
+	junk := strings.Repeat("!", block)
+	contents := contentsA + zeros[len(contentsA):] + zeros + zeros + contentsB[:block] + zeros + "tail"
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("zeroes", strings.NewReader(contents)); err != nil {
+			return err
+		}
+
+		if err := b.File("holes", sparseReader{
+			Reader: strings.NewReader(junk + junk + contentsB[:block] + junk + "tail"),
+			holes:  []Hole{{Offset: 0, Length: 2 * block}, {Offset: 3*block + 100, Length: block - 100}},
+		}); err != nil {
+			return err
+		}
+
+		return b.File("empty", strings.NewReader(zeros+zeros))
+	}, BlockSize4K)
+
+	for n, test := range [...]struct {
+		path, contents string
+		sparse         uint64
+		blocks         []uint32
+	}{
+		{"zeroes", contents, 3 * block, []uint32{1, 0, 0, 1, 0}},
+		{"holes", zeros + zeros + contentsB[:block] + junk + "tail", 2 * block, []uint32{0, 0, 1, 1}},
+		{"empty", zeros + zeros, 2 * block, []uint32{0, 0}},
+	} {
+		if err := readSqfsFile(sfs, test.path, test.contents); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+
+			continue
+		}
+
+		fi, err := sfs.Stat(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		f := fi.(fileStat)
+
+		if f.sparse != test.sparse {
+			t.Errorf("test %d: expecting %d sparse bytes, got %d", n+1, test.sparse, f.sparse)
+		}
+
+		blocks := make([]uint32, len(f.blockSizes))
+
+		for m, size := range f.blockSizes {
+			blocks[m] = min(size&sizeMask, 1)
+		}
+
+		if !slices.Equal(blocks, test.blocks) {
+			t.Errorf("test %d: expecting blocks %v, got %v", n+1, test.blocks, blocks)
+		}
+	}
+
+	f, err := sfs.Open("zeroes")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, 200)
+
+	if _, err = f.(io.ReaderAt).ReadAt(buf, 2*block-100); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if expected := contents[2*block-100 : 2*block+100]; string(buf) != expected {
+		t.Errorf("expecting to read %q, got %q", expected, buf)
+	}
+}
+
+func TestBuilderDeduplication(t *testing.T) {
+	const block = 1 << 12
+
+	contents := contentsB[:2*block] + contentsA
+	differentTail := contentsB[:2*block] + contentsC[:100]
+
+	for n, test := range [...]struct {
+		options []BuildOption
+		dedup   bool
+	}{
+		{[]BuildOption{BlockSize4K}, true},
+		{[]BuildOption{BlockSize4K, NoDeduplication()}, false},
+	} {
+		sfs := buildAndOpen(t, func(b *Builder) error {
+			for _, file := range [...]struct {
+				path, contents string
+			}{
+				{"fileA", contents},
+				{"fileB", differentTail},
+				{"fileC", contentsA},
+				{"dirA/fileD", contents},
+			} {
+				if err := b.File(file.path, strings.NewReader(file.contents)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}, test.options...)
+
+		var files [4]fileStat
+
+		for m, file := range [...]struct {
+			path, contents string
+		}{
+			{"fileA", contents},
+			{"fileB", differentTail},
+			{"fileC", contentsA},
+			{"dirA/fileD", contents},
+		} {
+			if err := readSqfsFile(sfs, file.path, file.contents); err != nil {
+				t.Errorf("test %d.%d: %s", n+1, m+1, err)
+			}
+
+			fi, err := sfs.Stat(file.path)
+			if err != nil {
+				t.Fatalf("test %d.%d: unexpected error: %s", n+1, m+1, err)
+			}
+
+			files[m] = fi.(fileStat)
+		}
+
+		if dedup := files[0].blocksStart == files[1].blocksStart; dedup != test.dedup {
+			t.Errorf("test %d: expecting block deduplication %v, got %v", n+1, test.dedup, dedup)
+		}
+
+		if dedup := files[0].blocksStart == files[3].blocksStart; dedup != test.dedup {
+			t.Errorf("test %d: expecting file deduplication %v, got %v", n+1, test.dedup, dedup)
+		}
+
+		if dedup := files[0].fragIndex == files[2].fragIndex && files[0].blockOffset == files[2].blockOffset; dedup != test.dedup {
+			t.Errorf("test %d: expecting fragment deduplication %v, got %v", n+1, test.dedup, dedup)
+		}
+
+		if files[0].blockOffset == files[1].blockOffset {
+			t.Errorf("test %d: expecting differing tails to use different fragments", n+1)
+		}
+
+		stat, err := sfs.reader.(*os.File).Stat()
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		if size := (sfs.superblock.BytesUsed + padTo - 1) &^ (padTo - 1); stat.Size() != int64(size) {
+			t.Errorf("test %d: expecting image size %d, got %d", n+1, size, stat.Size())
+		}
+	}
+
+	random := make([]byte, 16*block)
+
+	rand.New(rand.NewSource(0)).Read(random)
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("fileA", bytes.NewReader(random)); err != nil {
+			return err
+		}
+
+		return b.File("fileB", bytes.NewReader(random))
+	}, BlockSize4K)
+
+	if err := readSqfsFile(sfs, "fileB", string(random)); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := sfs.reader.(*os.File).Stat()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if size := (sfs.superblock.BytesUsed + padTo - 1) &^ (padTo - 1); stat.Size() != int64(size) {
+		t.Errorf("expecting rewound image to be truncated to %d, got %d", size, stat.Size())
+	}
+}
+
+func TestBuilderFileInvalidPath(t *testing.T) {
+	var images [2][]byte
+
+	for n, fail := range [...]bool{false, true} {
+		sfs := buildAndOpen(t, func(b *Builder) error {
+			if err := b.File("fileA", strings.NewReader(contentsA)); err != nil {
+				return err
+			}
+
+			if fail {
+				for m, test := range [...]struct {
+					path string
+					err  error
+				}{
+					{"fileA", fs.ErrExist},
+					{"fileA/fileB", fs.ErrInvalid},
+					{"../fileB", fs.ErrInvalid},
+					{".", fs.ErrExist},
+				} {
+					if err := b.File(test.path, strings.NewReader(contentsC)); !errors.Is(err, test.err) {
+						return fmt.Errorf("test %d: expecting error %v, got %v", m+1, test.err, err)
+					}
+				}
+			}
+
+			return b.File("fileC", strings.NewReader(contentsC))
+		}, BlockSize4K, SqfsModTime(0))
+
+		if err := readSqfsFile(sfs, "fileC", contentsC); err != nil {
+			t.Fatalf("test %d: %s", n+1, err)
+		}
+
+		var err error
+
+		if images[n], err = os.ReadFile(sfs.reader.(*os.File).Name()); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+	}
+
+	if !bytes.Equal(images[0], images[1]) {
+		t.Error("expecting failed file additions to leave no data in the image")
+	}
+}
+
+func TestBuilderCompressionWorkers(t *testing.T) {
+	random := make([]byte, 1<<20)
+
+	rand.New(rand.NewSource(0)).Read(random)
+
+	build := func(b *Builder) error {
+		for n := range 1 << 8 {
+			if err := b.File(fmt.Sprintf("small/file%d", n), strings.NewReader(fmt.Sprintf("%s%d", contentsC[:n*16], n))); err != nil {
+				return err
+			}
+
+			if n%32 == 0 {
+				if err := b.File(fmt.Sprintf("large/file%d", n), io.MultiReader(strings.NewReader(contentsD[:n*64]), bytes.NewReader(random[n*64:]))); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	var images [2][]byte
+
+	for n, workers := range [...]int{1, 4} {
+		sfs := buildAndOpen(t, build, BlockSize16K, Compression(&GZipOptions{CompressionLevel: 9, WindowSize: maximumWindowSize}), SqfsModTime(0), CompressionWorkers(workers))
+
+		for m := range 1 << 8 {
+			if err := readSqfsFile(sfs, fmt.Sprintf("small/file%d", m), fmt.Sprintf("%s%d", contentsC[:m*16], m)); err != nil {
+				t.Fatalf("test %d: %s", n+1, err)
+			}
+
+			if m%32 == 0 {
+				if err := readSqfsFile(sfs, fmt.Sprintf("large/file%d", m), contentsD[:m*64]+string(random[m*64:])); err != nil {
+					t.Fatalf("test %d: %s", n+1, err)
+				}
+			}
+		}
+
+		var err error
+
+		if images[n], err = os.ReadFile(sfs.reader.(*os.File).Name()); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+	}
+
+	if !bytes.Equal(images[0], images[1]) {
+		t.Error("expecting parallel compression to produce an identical image")
+	}
+
+	if _, err := Create(nil, CompressionWorkers(0)); !errors.Is(err, ErrInvalidWorkerCount) {
+		t.Errorf("expecting error ErrInvalidWorkerCount, got %v", err)
+	}
+}
+
+func TestBuilderReproducible(t *testing.T) {
+	epoch := time.Unix(1700000000, 0)
+	before := epoch.Add(-time.Hour)
+	after := epoch.Add(time.Hour)
+
+	t.Setenv("SOURCE_DATE_EPOCH", strconv.FormatInt(epoch.Unix(), 10))
+
+	build := func(b *Builder) error {
+		for n := range 1 << 6 {
+			if err := b.File(fmt.Sprintf("dir%d/file%d", n%4, n), strings.NewReader(contentsD[:n*256]), ModTime(after)); err != nil {
+				return err
+			}
+		}
+
+		if err := b.Dir("dirA", ModTime(after)); err != nil {
+			return err
+		}
+
+		return b.Symlink("dirA/link", "../dir0/file0", ModTime(before))
+	}
+
+	var images [2][]byte
+
+	for n, workers := range [...]int{1, 4} {
+		sfs := buildAndOpen(t, build, BlockSize4K, SourceDateEpoch(), CompressionWorkers(workers))
+
+		if !sfs.superblock.Stats.ModTime.Equal(epoch) {
+			t.Errorf("test %d: expecting superblock mod time %s, got %s", n+1, epoch, sfs.superblock.Stats.ModTime)
+		}
+
+		for m, test := range [...]struct {
+			path    string
+			modTime time.Time
+		}{
+			{"dir1/file5", epoch},
+			{"dirA", epoch},
+			{"dirA/link", before},
+		} {
+			if fi, err := sfs.LStat(test.path); err != nil {
+				t.Errorf("test %d.%d: unexpected error: %s", n+1, m+1, err)
+			} else if !fi.ModTime().Equal(test.modTime) {
+				t.Errorf("test %d.%d: expecting mod time %s, got %s", n+1, m+1, test.modTime, fi.ModTime())
+			}
+		}
+
+		var err error
+
+		if images[n], err = os.ReadFile(sfs.reader.(*os.File).Name()); err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+	}
+
+	if !bytes.Equal(images[0], images[1]) {
+		t.Error("expecting reproducible builds to produce identical images")
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+
+	if _, err := Create(nil, SourceDateEpoch()); !errors.Is(err, ErrInvalidSourceDateEpoch) {
+		t.Errorf("expecting error ErrInvalidSourceDateEpoch, got %v", err)
+	}
+}
+
+func buildImage(create func() (*Builder, error), build buildFn) error {
+	b, err := create()
+	if err != nil {
+		return err
+	}
+
+	if err = build(b); err != nil {
+		return err
+	}
+
+	return b.Close()
+}
+
+func TestBuilderAppendUnclosed(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.sqfs"))
+	if err != nil {
+		t.Fatalf("unexpected error creating squashfs file: %s", err)
+	}
+
+	defer f.Close()
+
+	if err := buildImage(func() (*Builder, error) {
+		return Create(f)
+	}, func(b *Builder) error {
+		return b.File("fileA", strings.NewReader(contentsA))
+	}); err != nil {
+		t.Fatalf("unexpected error building initial image: %s", err)
+	}
+
+	b, err := Append(f)
+	if err != nil {
+		t.Fatalf("unexpected error appending to image: %s", err)
+	}
+
+	if err := b.File("fileB", strings.NewReader(contentsD)); err != nil {
+		t.Fatalf("unexpected error adding file: %s", err)
+	}
+
+	if sfs, err := Open(f); err == nil {
+		if _, err = sfs.ReadDir("."); err == nil {
+			t.Error("expecting image to be unusable before Close")
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("unexpected error closing builder: %s", err)
+	}
+
+	sfs, err := Open(f)
+	if err != nil {
+		t.Fatalf("unexpected error opening squashfs reader: %s", err)
+	}
+
+	if err := readSqfsFile(sfs, "fileA", contentsA); err != nil {
+		t.Error(err)
+	}
+
+	if err := readSqfsFile(sfs, "fileB", contentsD); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuilderAppend(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.sqfs"))
+	if err != nil {
+		t.Fatalf("unexpected error creating squashfs file: %s", err)
+	}
+
+	defer f.Close()
+
+	if err := buildImage(func() (*Builder, error) {
+		return Create(f, BlockSize4K, ExportTable())
+	}, func(b *Builder) error {
+		if err := b.File("dirA/fileA", strings.NewReader(contentsA), Owner(1000, 1000)); err != nil {
+			return err
+		}
+
+		if err := b.File("dirA/fileB", strings.NewReader(contentsB), Xattr("user.attr", []byte("value"))); err != nil {
+			return err
+		}
+
+		if err := b.Symlink("dirA/symlinkA", "fileB"); err != nil {
+			return err
+		}
+
+		if err := b.Link("dirB/linkA", "dirA/fileA"); err != nil {
+			return err
+		}
+
+		return b.Dir("dirC", Owner(123, 456), Xattr("user.dir", []byte("dir")))
+	}); err != nil {
+		t.Fatalf("unexpected error building initial image: %s", err)
+	}
+
+	if _, err := Append(f, BlockSize16K); !errors.Is(err, ErrIncompatibleImage) {
+		t.Errorf("expecting error ErrIncompatibleImage, got %v", err)
+	}
+
+	if err := buildImage(func() (*Builder, error) {
+		return Append(f)
+	}, func(b *Builder) error {
+		if err := b.File("dirA/fileC", strings.NewReader(contentsC)); err != nil {
+			return err
+		}
+
+		if err := b.File("dirC/fileD", strings.NewReader(contentsA+contentsA)); err != nil {
+			return err
+		}
+
+		return b.Link("dirC/linkB", "dirA/fileA")
+	}); err != nil {
+		t.Fatalf("unexpected error appending to image: %s", err)
+	}
+
+	sfs, err := Open(f)
+	if err != nil {
+		t.Fatalf("unexpected error opening squashfs reader: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		path, contents string
+	}{
+		{"dirA/fileA", contentsA},
+		{"dirA/fileB", contentsB},
+		{"dirA/symlinkA", contentsB},
+		{"dirB/linkA", contentsA},
+		{"dirA/fileC", contentsC},
+		{"dirC/fileD", contentsA + contentsA},
+		{"dirC/linkB", contentsA},
+	} {
+		if err := readSqfsFile(sfs, test.path, test.contents); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+
+	for n, test := range [...]struct {
+		path, xattr, value string
+	}{
+		{"dirA/fileB", "user.attr", "value"},
+		{"dirC", "user.dir", "dir"},
+	} {
+		if value, err := sfs.GetXattr(test.path, test.xattr); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(value) != test.value {
+			t.Errorf("test %d: expecting xattr value %q, got %q", n+1, test.value, value)
+		}
+	}
+
+	for n, test := range [...]struct {
+		path      string
+		uid, gid  uint32
+		linkCount uint32
+	}{
+		{"dirA/fileA", 1000, 1000, 3},
+		{"dirB/linkA", 1000, 1000, 3},
+		{"dirC", 123, 456, 2},
+	} {
+		fi, err := sfs.Stat(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		var (
+			c         commonStat
+			linkCount uint32
+		)
+
+		switch fi := fi.(type) {
+		case fileStat:
+			c, linkCount = fi.commonStat, fi.linkCount
+		case dirStat:
+			c, linkCount = fi.commonStat, fi.linkCount
+		}
+
+		if c.uid != test.uid || c.gid != test.gid {
+			t.Errorf("test %d: expecting uid %d and gid %d, got %d and %d", n+1, test.uid, test.gid, c.uid, c.gid)
+		} else if linkCount != test.linkCount {
+			t.Errorf("test %d: expecting link count %d, got %d", n+1, test.linkCount, linkCount)
+		}
+	}
+
+	fi, err := sfs.StatInode(1)
+	if err != nil {
+		t.Fatalf("unexpected error stating inode: %s", err)
+	} else if !fi.IsDir() {
+		t.Errorf("expecting inode 1 to be the root directory")
+	}
+}
+
+func TestBuilderCopy(t *testing.T) {
+	const block = 1 << 12
+
+	sparse := contentsB[:block] + strings.Repeat("\x00", 2*block) + contentsA
+	modTime := time.Unix(1600000000, 0)
+
+	src := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("dirA/fileA", strings.NewReader(contentsA), Owner(1000, 1000), ModTime(modTime)); err != nil {
+			return err
+		}
+
+		if err := b.File("dirA/fileB", strings.NewReader(contentsB), Xattr("user.attr", []byte("value"))); err != nil {
+			return err
+		}
+
+		if err := b.File("dirA/sparse", strings.NewReader(sparse)); err != nil {
+			return err
+		}
+
+		if err := b.Symlink("dirA/symlink", "fileB"); err != nil {
+			return err
+		}
+
+		if err := b.Link("dirA/dirB/link", "dirA/fileB"); err != nil {
+			return err
+		}
+
+		if err := b.Char("dirA/char", 0x501, Mode(0o600)); err != nil {
+			return err
+		}
+
+		return b.Dir("dirA/dirC", Owner(123, 456), Mode(0o700))
+	}, BlockSize4K)
+
+	for n, options := range [...][]BuildOption{
+		{BlockSize4K},
+		{BlockSize16K},
+		{BlockSize4K, Compression(&ZStdOptions{CompressionLevel: 3})},
+		{BlockSize4K, CompressionWorkers(4)},
+	} {
+		sfs := buildAndOpen(t, func(b *Builder) error {
+			if err := b.Copy("copy", src, "dirA"); err != nil {
+				return err
+			}
+
+			if err := b.Copy("single", src, "dirA/fileB"); err != nil {
+				return err
+			}
+
+			if err := b.Copy("missing", src, "dirA/missing"); !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("expecting error ErrNotExist, got %v", err)
+			}
+
+			return nil
+		}, options...)
+
+		for m, test := range [...]struct {
+			path, contents string
+		}{
+			{"copy/fileA", contentsA},
+			{"copy/fileB", contentsB},
+			{"copy/sparse", sparse},
+			{"copy/symlink", contentsB},
+			{"copy/dirB/link", contentsB},
+			{"single", contentsB},
+		} {
+			if err := readSqfsFile(sfs, test.path, test.contents); err != nil {
+				t.Errorf("test %d.%d: %s", n+1, m+1, err)
+			}
+		}
+
+		for m, test := range [...]struct {
+			path     string
+			mode     fs.FileMode
+			uid, gid uint32
+			modTime  time.Time
+		}{
+			{"copy/fileA", 0o755, 1000, 1000, modTime},
+			{"copy/char", fs.ModeCharDevice | 0o600, 0, 0, time.Time{}},
+			{"copy/dirC", fs.ModeDir | 0o700, 123, 456, time.Time{}},
+		} {
+			fi, err := sfs.LStat(test.path)
+			if err != nil {
+				t.Errorf("test %d.%d: unexpected error: %s", n+1, m+1, err)
+
+				continue
+			}
+
+			c, _ := statCommon(fi)
+
+			if fi.Mode() != test.mode {
+				t.Errorf("test %d.%d: expecting mode %s, got %s", n+1, m+1, test.mode, fi.Mode())
+			} else if c.uid != test.uid || c.gid != test.gid {
+				t.Errorf("test %d.%d: expecting uid %d and gid %d, got %d and %d", n+1, m+1, test.uid, test.gid, c.uid, c.gid)
+			} else if !test.modTime.IsZero() && !fi.ModTime().Equal(test.modTime) {
+				t.Errorf("test %d.%d: expecting mod time %s, got %s", n+1, m+1, test.modTime, fi.ModTime())
+			}
+		}
+
+		if value, err := sfs.GetXattr("copy/fileB", "user.attr"); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(value) != "value" {
+			t.Errorf("test %d: expecting xattr value %q, got %q", n+1, "value", value)
+		}
+
+		fileB, _ := sfs.Stat("copy/fileB")
+		link, _ := sfs.Stat("copy/dirB/link")
+		single, _ := sfs.Stat("single")
+
+		if fileB.(fileStat).inode != link.(fileStat).inode {
+			t.Errorf("test %d: expecting hard link to be preserved", n+1)
+		} else if fileB.(fileStat).blocksStart != single.(fileStat).blocksStart {
+			t.Errorf("test %d: expecting copied blocks to be deduplicated", n+1)
+		}
+
+		if n == 0 || n == 3 {
+			srcFile, _ := src.Stat("dirA/fileB")
+
+			if !slices.Equal(fileB.(fileStat).blockSizes, srcFile.(fileStat).blockSizes) {
+				t.Errorf("test %d: expecting blocks to be copied without recompression", n+1)
+			}
+		}
+	}
+}
+
+func TestBuilderCopyCompressionOptions(t *testing.T) {
+	src := buildAndOpen(t, func(b *Builder) error {
+		return b.File("file", strings.NewReader(contentsB))
+	}, BlockSize4K, Compression(&XZOptions{DictionarySize: 1 << 16}))
+
+	srcFile, _ := src.Stat("file")
+	srcData := make([]byte, srcFile.(fileStat).blockSizes[0]&sizeMask)
+
+	src.reader.ReadAt(srcData, int64(srcFile.(fileStat).blocksStart))
+
+	for n, test := range [...]struct {
+		options CompressorOptions
+		raw     bool
+	}{
+		{&XZOptions{DictionarySize: 1 << 16}, true},
+		{&XZOptions{DictionarySize: 1 << 20}, true},
+		{&XZOptions{DictionarySize: 1 << 13}, false},
+		{DefaultXZOptions(), false},
+		{&GZipOptions{CompressionLevel: 9, WindowSize: 15}, false},
+	} {
+		sfs := buildAndOpen(t, func(b *Builder) error {
+			return b.Copy("file", src, "file")
+		}, BlockSize4K, Compression(test.options))
+
+		if err := readSqfsFile(sfs, "file", contentsB); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+
+		fi, _ := sfs.Stat("file")
+		data := make([]byte, fi.(fileStat).blockSizes[0]&sizeMask)
+
+		sfs.reader.ReadAt(data, int64(fi.(fileStat).blocksStart))
+
+		if raw := bytes.Equal(data, srcData); raw != test.raw {
+			t.Errorf("test %d: expecting raw copy %v, got %v", n+1, test.raw, raw)
+		}
+	}
+}
+
+func TestBuilderCopyCorrupt(t *testing.T) {
+	src := buildAndOpen(t, func(b *Builder) error {
+		return b.File("file", strings.NewReader(contentsB[:10000]))
+	}, BlockSize4K)
+
+	fi, err := src.Stat("file")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, corrupt := range [...]func(*fileStat){
+		func(f *fileStat) { f.blockSizes = []uint32{1 << 13, f.blockSizes[1]} },
+		func(f *fileStat) { f.blockSizes = []uint32{f.blockSizes[0], 1<<24 - 1} },
+		func(f *fileStat) { f.fileSize = 1 << 14 },
+		func(f *fileStat) { f.blockSizes = append(f.blockSizes, f.blockSizes...) },
+	} {
+		f := fi.(fileStat)
+		f.blockSizes = slices.Clone(f.blockSizes)
+
+		corrupt(&f)
+
+		buildAndOpen(t, func(b *Builder) error {
+			if err := b.copyFile("file", src, f, nil); !errors.Is(err, ErrInvalidBlockHeader) {
+				return fmt.Errorf("test %d: expecting error ErrInvalidBlockHeader, got %v", n+1, err)
+			}
+
+			return nil
+		}, BlockSize4K)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	const hole = 1 << 20
+
+	sparse := strings.Repeat(contentsC, hole/len(contentsC)) + strings.Repeat("\x00", hole) + contentsA
+	modTime := time.Unix(1600000000, 0)
+
+	src := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("dirA/fileA", strings.NewReader(contentsA), Owner(1000, 1000), ModTime(modTime)); err != nil {
+			return err
+		}
+
+		if err := b.File("dirA/fileB", strings.NewReader(contentsB), Xattr("user.attr", []byte("value"))); err != nil {
+			return err
+		}
+
+		if err := b.File("sparse", strings.NewReader(sparse), Mode(0o600)); err != nil {
+			return err
+		}
+
+		if err := b.Symlink("dirA/symlink", "fileB", Xattr("security.label", []byte("label"))); err != nil {
+			return err
+		}
+
+		if err := b.Link("link", "dirA/fileB"); err != nil {
+			return err
+		}
+
+		if err := b.Block("dev/block", 0x801, Owner(0, 6)); err != nil {
+			return err
+		}
+
+		if err := b.Char("dev/char", 0x10042c); err != nil {
+			return err
+		}
+
+		if err := b.FIFO("fifo"); err != nil {
+			return err
+		}
+
+		return b.Dir("dirA/dirB", Owner(123, 456), Mode(0o700), Xattr("user.dir", []byte("dir")))
+	}, BlockSize4K, SqfsModTime(1234), ExportTable(), DefaultModTime(modTime))
+
+	for n, options := range [...][]BuildOption{
+		{},
+		{BlockSize16K},
+		{Compression(&ZStdOptions{CompressionLevel: 3}), BlockSize1M},
+	} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "out.sqfs"))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error creating squashfs file: %s", n+1, err)
+		}
+
+		defer f.Close()
+
+		if err = Convert(src, f, options...); err != nil {
+			t.Fatalf("test %d: unexpected error converting image: %s", n+1, err)
+		}
+
+		dst, err := Open(f)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error opening squashfs reader: %s", n+1, err)
+		}
+
+		if dst.superblock.ModTime.Unix() != 1234 {
+			t.Errorf("test %d: expecting superblock mod time 1234, got %d", n+1, dst.superblock.ModTime.Unix())
+		} else if dst.superblock.ExportTable == noTable {
+			t.Errorf("test %d: expecting export table", n+1)
+		}
+
+		if err := compareTrees(src, dst); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+}
+
+func compareTrees(a, b *SquashFS) error {
+	inodes := make(map[uint32]uint32)
+
+	return fs.WalkDir(a, ".", func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fiA, err := a.LStat(path)
+		if err != nil {
+			return err
+		}
+
+		fiB, err := b.LStat(path)
+		if err != nil {
+			return err
+		}
+
+		cA, _ := statCommon(fiA)
+		cB, _ := statCommon(fiB)
+
+		if fiA.Mode() != fiB.Mode() || !fiA.ModTime().Equal(fiB.ModTime()) || cA.uid != cB.uid || cA.gid != cB.gid {
+			return fmt.Errorf("%s: expecting %s %s %d:%d, got %s %s %d:%d", path, fiA.Mode(), fiA.ModTime(), cA.uid, cA.gid, fiB.Mode(), fiB.ModTime(), cB.uid, cB.gid)
+		}
+
+		if inode, ok := inodes[cA.inode]; !ok {
+			inodes[cA.inode] = cB.inode
+		} else if inode != cB.inode {
+			return fmt.Errorf("%s: expecting hard link to inode %d, got %d", path, inode, cB.inode)
+		}
+
+		xattrsA, err := a.readXattrs(xattrIndex(fiA))
+		if err != nil {
+			return err
+		}
+
+		xattrsB, err := b.readXattrs(xattrIndex(fiB))
+		if err != nil {
+			return err
+		}
+
+		if !slices.EqualFunc(xattrsA, xattrsB, func(x, y xattr) bool { return x.key == y.key && bytes.Equal(x.value, y.value) }) {
+			return fmt.Errorf("%s: expecting xattrs %v, got %v", path, xattrsA, xattrsB)
+		}
+
+		switch fiA := fiA.(type) {
+		case fileStat:
+			if fiA.sparse != fiB.(fileStat).sparse {
+				return fmt.Errorf("%s: expecting %d sparse bytes, got %d", path, fiA.sparse, fiB.(fileStat).sparse)
+			}
+
+			contents, err := a.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			return readSqfsFile(b, path, string(contents))
+		case symlinkStat:
+			if fiA.targetPath != fiB.(symlinkStat).targetPath {
+				return fmt.Errorf("%s: expecting symlink target %q, got %q", path, fiA.targetPath, fiB.(symlinkStat).targetPath)
+			}
+		case blockStat:
+			if fiA.deviceNumber != fiB.(blockStat).deviceNumber {
+				return fmt.Errorf("%s: expecting device %d, got %d", path, fiA.deviceNumber, fiB.(blockStat).deviceNumber)
+			}
+		case charStat:
+			if fiA.deviceNumber != fiB.(charStat).deviceNumber {
+				return fmt.Errorf("%s: expecting device %d, got %d", path, fiA.deviceNumber, fiB.(charStat).deviceNumber)
+			}
+		}
+
+		return nil
+	})
+}
+
+type closeReader struct {
+	*strings.Reader
+	closed bool
+}
+
+func (c *closeReader) Close() error {
+	c.closed = true
+
+	return nil
+}
+
+func TestBuilderPseudo(t *testing.T) {
+	const pseudo = `# device nodes
+/dev d 755 0 0
+dev/console c 600 0 5 5 1
+dev/sda b 660 0 6 8 0
+dev/max c 600 0 0 4095 1048575
+dev/initctl p 600 0 0
+dev/log i 666 0 0 s
+"dir with spaces" d 700 1000 1000
+dir\ with\ spaces/fifo i 644 1000 1000 f
+etc/hostname f 644 0 0 echo firmware
+etc/hostname.link l etc/hostname
+etc/localtime s 777 0 0 /usr/share/zoneinfo/UTC
+etc/hostname x user.attr=some value
+dev/console x user.hex=0x686578
+dev/sda x security.base64=0sYmFzZTY0
+
+file m 4755 0 0
+/ m 750 0 0
+`
+
+	var firmware *closeReader
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.File("file", strings.NewReader(contentsA)); err != nil {
+			return err
+		}
+
+		if err := b.AddPseudo(strings.NewReader(pseudo), func(command string) (io.Reader, error) {
+			if command != "echo firmware" {
+				return nil, fs.ErrNotExist
+			}
+
+			firmware = &closeReader{Reader: strings.NewReader("firmware\n")}
+
+			return firmware, nil
+		}); err != nil {
+			return err
+		}
+
+		if !firmware.closed {
+			return errors.New("expecting command reader to be closed")
+		}
+
+		if err := b.AddPseudo(strings.NewReader("# comment\nfile x bad.attr=value"), nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+			return fmt.Errorf("expecting error on line 2, got %v", err)
+		}
+
+		for n, test := range [...]struct {
+			line string
+			err  error
+		}{
+			{"fileB f 644 0 0 cat data", ErrNoPseudoCommand},
+			{"fileB q 644 0 0", ErrInvalidPseudo},
+			{"fileB d 999 0 0", ErrInvalidPseudo},
+			{"fileB d 755 root 0", ErrInvalidPseudo},
+			{"fileB c 644 0 0 1", ErrInvalidPseudo},
+			{"fileB c 600 0 0 -1 5", ErrInvalidPseudo},
+			{"fileB b 600 0 0 8 -1", ErrInvalidPseudo},
+			{"fileB c 600 0 0 4096 0", fs.ErrInvalid},
+			{"fileB b 600 0 0 8 1048576", fs.ErrInvalid},
+			{"fileB i 644 0 0 x", ErrInvalidPseudo},
+			{"fileB x user.attr", ErrInvalidPseudo},
+			{"file x bad.attr=value", ErrInvalidXattr},
+			{"file x user.=value", ErrInvalidXattr},
+			{"file x user.attr=0xzz", ErrInvalidPseudo},
+			{"file x user.attr=0s!!", ErrInvalidPseudo},
+			{"\"fileB d 755 0 0", ErrInvalidPseudo},
+			{"missing m 644 0 0", fs.ErrNotExist},
+		} {
+			if err := b.AddPseudo(strings.NewReader(test.line), nil); !errors.Is(err, test.err) {
+				return fmt.Errorf("test %d: expecting error %v, got %v", n+1, test.err, err)
+			}
+		}
+
+		return nil
+	})
+
+	for n, test := range [...]struct {
+		path     string
+		mode     fs.FileMode
+		uid, gid uint32
+	}{
+		{".", fs.ModeDir | 0o750, 0, 0},
+		{"dev", fs.ModeDir | 0o755, 0, 0},
+		{"dev/console", fs.ModeCharDevice | 0o600, 0, 5},
+		{"dev/sda", fs.ModeDevice | 0o660, 0, 6},
+		{"dev/initctl", fs.ModeNamedPipe | 0o600, 0, 0},
+		{"dev/log", fs.ModeSocket | 0o666, 0, 0},
+		{"dir with spaces", fs.ModeDir | 0o700, 1000, 1000},
+		{"dir with spaces/fifo", fs.ModeNamedPipe | 0o644, 1000, 1000},
+		{"etc/hostname", 0o644, 0, 0},
+		{"etc/hostname.link", 0o644, 0, 0},
+		{"etc/localtime", fs.ModeSymlink | 0o777, 0, 0},
+		{"file", 0o4755, 0, 0},
+	} {
+		fi, err := sfs.LStat(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		c, _ := statCommon(fi)
+
+		if fi.Mode() != test.mode {
+			t.Errorf("test %d: expecting mode %s, got %s", n+1, test.mode, fi.Mode())
+		} else if c.uid != test.uid || c.gid != test.gid {
+			t.Errorf("test %d: expecting uid %d and gid %d, got %d and %d", n+1, test.uid, test.gid, c.uid, c.gid)
+		}
+	}
+
+	if err := readSqfsFile(sfs, "etc/hostname.link", "firmware\n"); err != nil {
+		t.Error(err)
+	}
+
+	if target, err := sfs.ReadLink("etc/localtime"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if target != "/usr/share/zoneinfo/UTC" {
+		t.Errorf("expecting symlink target %q, got %q", "/usr/share/zoneinfo/UTC", target)
+	}
+
+	if value, err := sfs.GetXattr("etc/hostname.link", "user.attr"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(value) != "some value" {
+		t.Errorf("expecting xattr value %q, got %q", "some value", value)
+	}
+
+	for n, test := range [...]struct {
+		path, name, value string
+	}{
+		{"dev/console", "user.hex", "hex"},
+		{"dev/sda", "security.base64", "base64"},
+	} {
+		if value, err := sfs.GetXattr(test.path, test.name); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(value) != test.value {
+			t.Errorf("test %d: expecting xattr value %q, got %q", n+1, test.value, value)
+		}
+	}
+
+	for n, test := range [...]struct {
+		path   string
+		device uint32
+	}{
+		{"dev/console", 0x501},
+		{"dev/sda", 0x800},
+		{"dev/max", 0xffffffff},
+	} {
+		fi, _ := sfs.LStat(test.path)
+
+		if device := deviceNumber(fi); device != test.device {
+			t.Errorf("test %d: expecting device %x, got %x", n+1, test.device, device)
+		}
+	}
+}
+
+type errWriter struct {
+	io.WriterAt
+	fail bool
+}
+
+func (e *errWriter) WriteAt(p []byte, off int64) (int, error) {
+	if e.fail {
+		return 0, io.ErrShortWrite
+	}
+
+	return e.WriterAt.WriteAt(p, off)
+}
+
+func TestBuilderCompressionWorkersStopped(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.sqfs"))
+	if err != nil {
+		t.Fatalf("unexpected error creating file: %s", err)
+	}
+
+	defer f.Close()
+
+	w := errWriter{WriterAt: f}
+
+	b, err := Create(&w, BlockSize4K, CompressionWorkers(4))
+	if err != nil {
+		t.Fatalf("unexpected error creating builder: %s", err)
+	}
+
+	for n := range 9 {
+		if err = b.File(fmt.Sprintf("file%d", n), strings.NewReader(contentsB[n:n+3000])); err != nil {
+			t.Fatalf("unexpected error adding file: %s", err)
+		}
+	}
+
+	w.fail = true
+
+	if err = b.Close(); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("expecting error ErrShortWrite, got %v", err)
+	}
+
+	for range 100 {
+		if runtime.NumGoroutine() <= goroutines {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("expecting %d goroutines, got %d", goroutines, runtime.NumGoroutine())
+}
+
+func TestBuilderAddFS(t *testing.T) {
+	timeA := time.Unix(1700000000, 0)
+	timeB := time.Unix(1600000000, 0)
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		if err := b.AddFS("", fstest.MapFS{
+			"dirA":       {Mode: fs.ModeDir | 0o750, ModTime: timeA},
+			"dirA/fileA": {Data: []byte(contentsA), Mode: 0o640, ModTime: timeB},
+			"fileB":      {Data: []byte(contentsB), Mode: 0o600, ModTime: timeA},
+			"dev/block":  {Mode: fs.ModeDevice | 0o600, ModTime: timeB, Sys: blockStat{deviceNumber: 0x801}},
+			"dev/char":   {Mode: fs.ModeDevice | fs.ModeCharDevice | 0o620, ModTime: timeB, Sys: charStat{deviceNumber: 0x501}},
+			"fifo":       {Mode: fs.ModeNamedPipe | 0o644, ModTime: timeA},
+			"setuid":     {Data: []byte(contentsA), Mode: fs.ModeSetuid | fs.ModeSetgid | 0o755, ModTime: timeA},
+			"tmp":        {Mode: fs.ModeDir | fs.ModeSticky | 0o777, ModTime: timeB},
+		}); err != nil {
+			return err
+		}
+
+		return b.Symlink("link", "fileB", ModTime(timeB))
+	})
+
+	for n, test := range [...]struct {
+		path string
+		mode fs.FileMode
+	}{
+		{"setuid", 0o6755},
+		{"tmp", fs.ModeDir | 0o1777},
+	} {
+		if fi, err := sfs.Stat(test.path); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if fi.Mode() != test.mode {
+			t.Errorf("test %d: expecting mode %s, got %s", n+1, test.mode, fi.Mode())
+		}
+	}
+
+	sfs = buildAndOpen(t, func(b *Builder) error {
+		return b.AddFS("copy", sfs)
+	})
+
+	for n, test := range [...]struct {
+		path    string
+		mode    fs.FileMode
+		modTime time.Time
+		device  uint32
+	}{
+		{"copy/dirA", fs.ModeDir | 0o750, timeA, 0},
+		{"copy/dirA/fileA", 0o640, timeB, 0},
+		{"copy/fileB", 0o600, timeA, 0},
+		{"copy/dev/block", fs.ModeDevice | 0o600, timeB, 0x801},
+		{"copy/dev/char", fs.ModeCharDevice | 0o620, timeB, 0x501},
+		{"copy/fifo", fs.ModeNamedPipe | 0o644, timeA, 0},
+		{"copy/link", fs.ModeSymlink | defaultPerms, timeB, 0},
+	} {
+		fi, err := sfs.LStat(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if fi.Mode() != test.mode {
+			t.Errorf("test %d: expecting mode %s, got %s", n+1, test.mode, fi.Mode())
+		}
+
+		if !fi.ModTime().Equal(test.modTime) {
+			t.Errorf("test %d: expecting mod time %s, got %s", n+1, test.modTime, fi.ModTime())
+		}
+
+		if device := deviceNumber(fi); device != test.device {
+			t.Errorf("test %d: expecting device number %d, got %d", n+1, test.device, device)
+		}
+	}
+
+	if err := readSqfsFile(sfs, "copy/dirA/fileA", contentsA); err != nil {
+		t.Error(err)
+	}
+
+	if err := readSqfsFile(sfs, "copy/fileB", contentsB); err != nil {
+		t.Error(err)
+	}
+
+	if target, err := sfs.ReadLink("copy/link"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if target != "fileB" {
+		t.Errorf("expecting symlink target %q, got %q", "fileB", target)
+	}
+}
+
+func TestBuilderAddTar(t *testing.T) {
+	timestamp := time.Unix(1700000000, 0)
+
+	var buf bytes.Buffer
+
+	w := tar.NewWriter(&buf)
+
+	for _, hdr := range [...]tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "global"}},
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0o711, ModTime: timestamp},
+		{Name: "./dirA/", Typeflag: tar.TypeDir, Mode: 0o750, Uid: 1000, Gid: 100, ModTime: timestamp},
+		{Name: "./dirA/fileA", Typeflag: tar.TypeReg, Mode: 0o4755, Uid: 1000, Gid: 1000, ModTime: timestamp, Size: int64(len(contentsA)), PAXRecords: map[string]string{"SCHILY.xattr.user.comment": "tar xattr", "SCHILY.xattr.system.posix_acl_access": "\x02\x00\x00\x00"}},
+		{Name: "./dirB/linkA", Typeflag: tar.TypeLink, Linkname: "./dirA/fileA"},
+		{Name: "./dirB/symlinkA", Typeflag: tar.TypeSymlink, Linkname: "../dirA/fileA", Mode: 0o644, ModTime: timestamp},
+		{Name: "./dev/sda1", Typeflag: tar.TypeBlock, Devmajor: 8, Devminor: 1, Mode: 0o660, ModTime: timestamp},
+		{Name: "./dev/tty300", Typeflag: tar.TypeChar, Devmajor: 4, Devminor: 300, Mode: 0o620, ModTime: timestamp},
+		{Name: "./fifo", Typeflag: tar.TypeFifo, Mode: 0o644, ModTime: timestamp},
+	} {
+		if err := w.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unexpected error writing tar header: %s", err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			io.WriteString(w, contentsA)
+		}
+	}
+
+	w.Close()
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		return b.AddTar("", &buf)
+	})
+
+	if err := readSqfsFile(sfs, "dirB/linkA", contentsA); err != nil {
+		t.Error(err)
+	}
+
+	if err := readSqfsFile(sfs, "dirB/symlinkA", contentsA); err != nil {
+		t.Error(err)
+	}
+
+	if value, err := sfs.GetXattr("dirB/linkA", "user.comment"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(value) != "tar xattr" {
+		t.Errorf("expecting xattr value %q, got %q", "tar xattr", value)
+	}
+
+	if names, err := sfs.ListXattr("dirA/fileA"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if !slices.Equal(names, []string{"user.comment"}) {
+		t.Errorf("expecting xattrs %v, got %v", []string{"user.comment"}, names)
+	}
+
+	if _, err := sfs.Stat("pax_global_header"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expecting error ErrNotExist, got %v", err)
+	}
+
+	for n, test := range [...]struct {
+		path     string
+		mode     fs.FileMode
+		uid, gid uint32
+		device   uint32
+	}{
+		{".", fs.ModeDir | 0o711, 0, 0, 0},
+		{"dirA", fs.ModeDir | 0o750, 1000, 100, 0},
+		{"dirA/fileA", 0o4755, 1000, 1000, 0},
+		{"dirB/linkA", 0o4755, 1000, 1000, 0},
+		{"dirB/symlinkA", fs.ModeSymlink | 0o777, 0, 0, 0},
+		{"dev/sda1", fs.ModeDevice | 0o660, 0, 0, 0x801},
+		{"dev/tty300", fs.ModeCharDevice | 0o620, 0, 0, 0x10042c},
+		{"fifo", fs.ModeNamedPipe | 0o644, 0, 0, 0},
+	} {
+		fi, err := sfs.LStat(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		var c commonStat
+
+		switch fi := fi.(type) {
+		case fileStat:
+			c = fi.commonStat
+		case dirStat:
+			c = fi.commonStat
+		}
+
+		if fi.Mode() != test.mode {
+			t.Errorf("test %d: expecting mode %s, got %s", n+1, test.mode, fi.Mode())
+		} else if c.uid != test.uid || c.gid != test.gid {
+			t.Errorf("test %d: expecting owner %d:%d, got %d:%d", n+1, test.uid, test.gid, c.uid, c.gid)
+		} else if !fi.ModTime().Equal(timestamp) {
+			t.Errorf("test %d: expecting mod time %s, got %s", n+1, timestamp, fi.ModTime())
+		} else if device := deviceNumber(fi); device != test.device {
+			t.Errorf("test %d: expecting device number %x, got %x", n+1, test.device, device)
+		}
+	}
+}
+
+func TestBuilderAddTarUnknownType(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := tar.NewWriter(&buf)
+
+	w.WriteHeader(&tar.Header{Name: "unknown", Typeflag: 'Z', Mode: 0o644})
+	w.Close()
+
+	buildAndOpen(t, func(b *Builder) error {
+		var pe *fs.PathError
+
+		if err := b.AddTar("", &buf); !errors.Is(err, fs.ErrInvalid) {
+			return fmt.Errorf("expecting error ErrInvalid, got %v", err)
+		} else if !errors.As(err, &pe) || pe.Path != "unknown" {
+			return fmt.Errorf("expecting path error for %q, got %v", "unknown", err)
+		}
+
+		return nil
+	})
+}
+
+func TestBuilderOCILayers(t *testing.T) {
+	layer := func(children ...child) io.Reader {
+		var buf bytes.Buffer
+
+		w := tar.NewWriter(&buf)
+
+		for _, c := range children {
+			if err := c.writeTo(w, ""); err != nil {
+				t.Fatalf("unexpected error writing tar: %s", err)
+			}
+		}
+
+		w.Close()
+
+		return &buf
+	}
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		return b.AddOCILayers(
+			layer(
+				dirData("dirA", nil),
+				fileData("dirA/fileA", contentsA),
+				fileData("dirA/fileB", contentsB),
+				dirData("dirB", nil),
+				fileData("dirB/sub/fileC", contentsC),
+				fileData("dirB/fileD", contentsD),
+				fileData("fileD", contentsD),
+				fileData("dirC/fileE", contentsE),
+				&link{Header: tar.Header{Name: "hardA", Typeflag: tar.TypeLink, Linkname: "dirA/fileA"}},
+			),
+			layer(
+				fileData("dirA/.wh.fileA", ""),
+				fileData("dirB/fileF", contentsA),
+				dirData("dirB/sub", nil),
+				fileData("dirB/sub/fileG", contentsB),
+				fileData("dirB/.wh..wh..opq", ""),
+				fileData("fileD", contentsC),
+				fileData("dirC", contentsE),
+				fileData(".wh.missing", ""),
+			),
+			layer(
+				&link{Header: tar.Header{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "global"}}},
+				fileData("dirA/fileA", contentsB, setXattr("user.comment", "oci xattr"), setXattr("system.posix_acl_access", "\x02\x00\x00\x00")),
+			),
+		)
+	})
+
+	for n, test := range [...]struct {
+		path, contents string
+	}{
+		{"dirA/fileA", contentsB},
+		{"dirA/fileB", contentsB},
+		{"dirB/fileF", contentsA},
+		{"dirB/sub/fileG", contentsB},
+		{"fileD", contentsC},
+		{"dirC", contentsE},
+		{"hardA", contentsA},
+	} {
+		if err := readSqfsFile(sfs, test.path, test.contents); err != nil {
+			t.Errorf("test %d: %s", n+1, err)
+		}
+	}
+
+	for n, test := range [...]struct {
+		path    string
+		entries []string
+	}{
+		{".", []string{"dirA", "dirB", "dirC", "fileD", "hardA"}},
+		{"dirA", []string{"fileA", "fileB"}},
+		{"dirB", []string{"fileF", "sub"}},
+		{"dirB/sub", []string{"fileG"}},
+	} {
+		entries, err := sfs.ReadDir(test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		names := make([]string, len(entries))
+
+		for m, e := range entries {
+			names[m] = e.Name()
+		}
+
+		if !slices.Equal(names, test.entries) {
+			t.Errorf("test %d: expecting entries %v, got %v", n+1, test.entries, names)
+		}
+	}
+
+	if fi, err := sfs.Stat("hardA"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if linkCount := fi.(fileStat).linkCount; linkCount != 1 {
+		t.Errorf("expecting link count 1, got %d", linkCount)
+	}
+
+	if names, err := sfs.ListXattr("dirA/fileA"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if !slices.Equal(names, []string{"user.comment"}) {
+		t.Errorf("expecting xattrs %v, got %v", []string{"user.comment"}, names)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"math/bits"
+	"sync"
 
 	"vimagination.zapto.org/byteio"
 )
@@ -24,12 +25,13 @@ const (
 
 	maxAlgorithm = 4
 
-	lzoDefaultAlgorithm        = 4
+	lzoDefaultAlgorithm        = lzoAlgorithm1X999
 	lzoDefaultCompressionLevel = 8
 
 	maxDictionarySize = 8192
 
-	maxZStdCompressionLevel = 22
+	zstdDefaultCompressionLevel = 15
+	maxZStdCompressionLevel     = 22
 
 	maxFilters = 63
 )
@@ -37,83 +39,145 @@ const (
 type Compressor uint16
 
 func (c Compressor) String() string {
-	switch c {
-	case CompressorGZIP:
-		return "gzip"
-	case CompressorLZMA:
-		return "lzma"
-	case CompressorLZO:
-		return "lzo"
-	case CompressorXZ:
-		return "xz"
-	case CompressorLZ4:
-		return "lz4"
-	case CompressorZSTD:
-		return "zstd"
+	if r, ok := getCompressor(c); ok {
+		return r.name
 	}
 
 	return "unknown"
 }
 
 func (c Compressor) decompress(r io.Reader) (io.Reader, error) {
-	switch c {
-	case CompressorGZIP:
-		return zlib.NewReader(r)
-	default:
-		return nil, fmt.Errorf("%s: %w", c, ErrUnsupportedCompressor)
+	if cr, ok := getCompressor(c); ok && cr.decompressor != nil {
+		return cr.decompressor(r)
 	}
+
+	return nil, fmt.Errorf("%s: %w", c, ErrUnsupportedCompressor)
 }
 
-type compressedWriter interface {
+func (c Compressor) compressedWriter(o CompressorOptions) (CompressedWriter, error) {
+	if cr, ok := getCompressor(c); ok && cr.writer != nil {
+		return cr.writer(o)
+	}
+
+	return nil, fmt.Errorf("%s: %w", c, ErrUnsupportedCompressor)
+}
+
+func (c Compressor) parseOptions(hasOptionsFlag bool, ler *byteio.StickyLittleEndianReader) (CompressorOptions, error) {
+	if cr, ok := getCompressor(c); ok && cr.options != nil {
+		return cr.options(hasOptionsFlag, ler)
+	}
+
+	return nil, ErrInvalidCompressor
+}
+
+// CompressedWriter is a resettable compressing writer. Each block is written
+// after a call to Reset and must be fully flushed to the underlying writer by
+// Close.
+type CompressedWriter interface {
 	io.Writer
 	Reset(io.Writer)
-	Flush() error
+	Close() error
 }
 
+// CompressorOptions represents the compressor specific options that are stored
+// after the superblock.
 type CompressorOptions interface {
-	getCompressedWriter() (compressedWriter, error)
-	asCompressor() Compressor
-	isDefault() bool
-	writeTo(*byteio.StickyLittleEndianWriter)
+	AsCompressor() Compressor
+	IsDefault() bool
+	WriteOptions(*byteio.StickyLittleEndianWriter)
+}
+
+// Decompressor returns a reader that decompresses a single block read from
+// the passed reader.
+type Decompressor func(io.Reader) (io.Reader, error)
+
+// WriterFactory creates a CompressedWriter using the passed options.
+type WriterFactory func(CompressorOptions) (CompressedWriter, error)
+
+// OptionsParser reads the compressor options from the superblock. When
+// hasOptions is false no options are stored in the image and the defaults
+// should be returned.
+type OptionsParser func(hasOptions bool, ler *byteio.StickyLittleEndianReader) (CompressorOptions, error)
+
+type registeredCompressor struct {
+	name         string
+	decompressor Decompressor
+	writer       WriterFactory
+	options      OptionsParser
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[Compressor]registeredCompressor{
+		CompressorGZIP: {"gzip", decompressGZip, optionsWriter((*GZipOptions).getCompressedWriter), defaultableOptions(parseGZipOptions, DefaultGzipOptions)},
+		CompressorLZMA: {"lzma", decompressLZMA, optionsWriter(LZMAOptions.getCompressedWriter), parseLZMAOptions},
+		CompressorLZO:  {"lzo", decompressLZO, optionsWriter((*LZOOptions).getCompressedWriter), defaultableOptions(parseLZOOptions, DefaultLZOOptions)},
+		CompressorXZ:   {"xz", decompressXZ, optionsWriter((*XZOptions).getCompressedWriter), defaultableOptions(parseXZOptions, DefaultXZOptions)},
+		CompressorLZ4:  {"lz4", decompressLZ4, optionsWriter((*LZ4Options).getCompressedWriter), requiredOptions(parseLZ4Options)},
+		CompressorZSTD: {"zstd", decompressZStd, optionsWriter((*ZStdOptions).getCompressedWriter), defaultableOptions(parseZStdOptions, DefaultZStdOptions)},
+	}
+)
+
+// RegisterCompressor sets the functions used to decompress, compress and read
+// the options of the given Compressor, replacing any existing implementation.
+//
+// A nil decompressor or writer makes the compressor unavailable for reading or
+// writing, respectively.
+func RegisterCompressor(c Compressor, name string, decompressor Decompressor, writer WriterFactory, options OptionsParser) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	compressors[c] = registeredCompressor{
+		name:         name,
+		decompressor: decompressor,
+		writer:       writer,
+		options:      options,
+	}
 }
 
-func (c Compressor) parseOptions(hasOptionsFlag bool, ler *byteio.StickyLittleEndianReader) (CompressorOptions, error) {
-	switch c {
-	case CompressorGZIP:
-		if hasOptionsFlag {
-			return parseGZipOptions(ler)
-		}
+func getCompressor(c Compressor) (registeredCompressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
 
-		return DefaultGzipOptions(), nil
-	case CompressorLZMA:
-		if hasOptionsFlag {
-			return nil, ErrNoCompressorOptions
-		}
+	r, ok := compressors[c]
+
+	return r, ok
+}
 
-		return DefaultLZMAOptions(), nil
-	case CompressorLZO:
-		if hasOptionsFlag {
-			return parseLZOOptions(ler)
+func optionsWriter[T CompressorOptions](fn func(T) (CompressedWriter, error)) WriterFactory {
+	return func(o CompressorOptions) (CompressedWriter, error) {
+		t, ok := o.(T)
+		if !ok {
+			return nil, ErrInvalidCompressorOptions
 		}
 
-		return DefaultLZOOptions(), nil
-	case CompressorXZ:
-		if hasOptionsFlag {
-			return parseXZOptions(ler)
+		return fn(t)
+	}
+}
+
+func defaultableOptions[T CompressorOptions](parse func(*byteio.StickyLittleEndianReader) (T, error), defaults func() T) OptionsParser {
+	return func(hasOptions bool, ler *byteio.StickyLittleEndianReader) (CompressorOptions, error) {
+		if !hasOptions {
+			return defaults(), nil
 		}
 
-		return DefaultXZOptions(), nil
-	case CompressorLZ4:
-		return parseLZ4Options(ler)
-	case CompressorZSTD:
-		if hasOptionsFlag {
-			return parseZStdOptions(ler)
+		return requiredOptions(parse)(true, ler)
+	}
+}
+
+func requiredOptions[T CompressorOptions](parse func(*byteio.StickyLittleEndianReader) (T, error)) OptionsParser {
+	return func(_ bool, ler *byteio.StickyLittleEndianReader) (CompressorOptions, error) {
+		o, err := parse(ler)
+		if err != nil {
+			return nil, err
 		}
 
-		return DefaultZStdOptions(), nil
+		return o, nil
 	}
+}
 
-	return nil, ErrInvalidCompressor
+func decompressGZip(r io.Reader) (io.Reader, error) {
+	return zlib.NewReader(r)
 }
 
 type GZipOptions struct {
@@ -152,19 +216,19 @@ func DefaultGzipOptions() *GZipOptions {
 	}
 }
 
-func (g *GZipOptions) getCompressedWriter() (compressedWriter, error) {
+func (g *GZipOptions) getCompressedWriter() (CompressedWriter, error) {
 	return zlib.NewWriterLevel(nil, int(g.CompressionLevel))
 }
 
-func (GZipOptions) asCompressor() Compressor {
+func (GZipOptions) AsCompressor() Compressor {
 	return CompressorGZIP
 }
 
-func (g *GZipOptions) isDefault() bool {
+func (g *GZipOptions) IsDefault() bool {
 	return g.CompressionLevel == zlib.BestCompression && g.WindowSize == maximumWindowSize
 }
 
-func (g *GZipOptions) writeTo(w *byteio.StickyLittleEndianWriter) {
+func (g *GZipOptions) WriteOptions(w *byteio.StickyLittleEndianWriter) {
 	w.WriteUint32(g.CompressionLevel)
 	w.WriteUint16(g.WindowSize)
 	w.WriteUint16(g.Strategies)
@@ -172,23 +236,31 @@ func (g *GZipOptions) writeTo(w *byteio.StickyLittleEndianWriter) {
 
 type LZMAOptions struct{}
 
+func parseLZMAOptions(hasOptions bool, _ *byteio.StickyLittleEndianReader) (CompressorOptions, error) {
+	if hasOptions {
+		return nil, ErrNoCompressorOptions
+	}
+
+	return DefaultLZMAOptions(), nil
+}
+
 func DefaultLZMAOptions() LZMAOptions {
 	return LZMAOptions{}
 }
 
-func (LZMAOptions) getCompressedWriter() (compressedWriter, error) {
+func (LZMAOptions) getCompressedWriter() (CompressedWriter, error) {
 	return nil, ErrUnsupportedCompressor
 }
 
-func (LZMAOptions) asCompressor() Compressor {
+func (LZMAOptions) AsCompressor() Compressor {
 	return CompressorLZMA
 }
 
-func (LZMAOptions) isDefault() bool {
+func (LZMAOptions) IsDefault() bool {
 	return true
 }
 
-func (LZMAOptions) writeTo(_ *byteio.StickyLittleEndianWriter) {}
+func (LZMAOptions) WriteOptions(_ *byteio.StickyLittleEndianWriter) {}
 
 type LZOOptions struct {
 	Algorithm        uint32
@@ -202,7 +274,7 @@ func parseLZOOptions(ler *byteio.StickyLittleEndianReader) (*LZOOptions, error)
 	}
 
 	compressionlevel := ler.ReadUint32()
-	if compressionlevel > zlib.BestCompression || algorithm != 4 && compressionlevel != 0 {
+	if compressionlevel > zlib.BestCompression || algorithm != lzoAlgorithm1X999 && compressionlevel != 0 {
 		return nil, ErrInvalidCompressionLevel
 	}
 
@@ -219,19 +291,25 @@ func DefaultLZOOptions() *LZOOptions {
 	}
 }
 
-func (l *LZOOptions) isDefault() bool {
+func (l *LZOOptions) IsDefault() bool {
 	return l.CompressionLevel == lzoDefaultCompressionLevel && l.Algorithm == lzoDefaultAlgorithm
 }
 
-func (LZOOptions) getCompressedWriter() (compressedWriter, error) {
-	return nil, ErrUnsupportedCompressor
+func (l *LZOOptions) getCompressedWriter() (CompressedWriter, error) {
+	if l.Algorithm > maxAlgorithm {
+		return nil, ErrInvalidCompressionAlgorithm
+	} else if l.CompressionLevel > zlib.BestCompression || l.Algorithm != lzoAlgorithm1X999 && l.CompressionLevel != 0 {
+		return nil, ErrInvalidCompressionLevel
+	}
+
+	return newLZOWriter(l.Algorithm, l.CompressionLevel), nil
 }
 
-func (LZOOptions) asCompressor() Compressor {
+func (LZOOptions) AsCompressor() Compressor {
 	return CompressorLZO
 }
 
-func (l *LZOOptions) writeTo(w *byteio.StickyLittleEndianWriter) {
+func (l *LZOOptions) WriteOptions(w *byteio.StickyLittleEndianWriter) {
 	w.WriteUint32(l.Algorithm)
 	w.WriteUint32(l.CompressionLevel)
 }
@@ -266,19 +344,19 @@ func DefaultXZOptions() *XZOptions {
 	}
 }
 
-func (XZOptions) getCompressedWriter() (compressedWriter, error) {
-	return nil, ErrUnsupportedCompressor
+func (x *XZOptions) getCompressedWriter() (CompressedWriter, error) {
+	return newXZWriter(x.DictionarySize, x.Filters), nil
 }
 
-func (XZOptions) asCompressor() Compressor {
+func (XZOptions) AsCompressor() Compressor {
 	return CompressorXZ
 }
 
-func (x *XZOptions) isDefault() bool {
+func (x *XZOptions) IsDefault() bool {
 	return x.DictionarySize == maxDictionarySize && x.Filters == 0
 }
 
-func (x *XZOptions) writeTo(w *byteio.StickyLittleEndianWriter) {
+func (x *XZOptions) WriteOptions(w *byteio.StickyLittleEndianWriter) {
 	w.WriteUint32(x.DictionarySize)
 	w.WriteUint32(x.Filters)
 }
@@ -289,34 +367,46 @@ type LZ4Options struct {
 }
 
 func parseLZ4Options(ler *byteio.StickyLittleEndianReader) (*LZ4Options, error) {
-	if ler.ReadUint32() != 1 {
+	if ler.ReadUint32() != lz4Version {
 		return nil, ErrInvalidCompressorVersion
 	}
 
 	flags := ler.ReadUint32()
-	if flags > 1 {
+	if flags > lz4FlagHC {
 		return nil, ErrInvalidCompressorFlags
 	}
 
 	return &LZ4Options{
-		Version: 1,
+		Version: lz4Version,
 		Flags:   flags,
 	}, nil
 }
 
-func (LZ4Options) getCompressedWriter() (compressedWriter, error) {
-	return nil, ErrUnsupportedCompressor
+func DefaultLZ4Options() *LZ4Options {
+	return &LZ4Options{
+		Version: lz4Version,
+	}
 }
 
-func (LZ4Options) asCompressor() Compressor {
+func (l *LZ4Options) getCompressedWriter() (CompressedWriter, error) {
+	if l.Version != lz4Version {
+		return nil, ErrInvalidCompressorVersion
+	} else if l.Flags > lz4FlagHC {
+		return nil, ErrInvalidCompressorFlags
+	}
+
+	return newLZ4Writer(l.Flags&lz4FlagHC != 0), nil
+}
+
+func (LZ4Options) AsCompressor() Compressor {
 	return CompressorLZ4
 }
 
-func (LZ4Options) isDefault() bool {
+func (LZ4Options) IsDefault() bool {
 	return false
 }
 
-func (l *LZ4Options) writeTo(w *byteio.StickyLittleEndianWriter) {
+func (l *LZ4Options) WriteOptions(w *byteio.StickyLittleEndianWriter) {
 	w.WriteUint32(l.Version)
 	w.WriteUint32(l.Flags)
 }
@@ -338,22 +428,26 @@ func parseZStdOptions(ler *byteio.StickyLittleEndianReader) (*ZStdOptions, error
 
 func DefaultZStdOptions() *ZStdOptions {
 	return &ZStdOptions{
-		CompressionLevel: zlib.BestCompression,
+		CompressionLevel: zstdDefaultCompressionLevel,
 	}
 }
 
-func (ZStdOptions) getCompressedWriter() (compressedWriter, error) {
-	return nil, ErrUnsupportedCompressor
+func (z *ZStdOptions) getCompressedWriter() (CompressedWriter, error) {
+	if z.CompressionLevel == 0 || z.CompressionLevel > maxZStdCompressionLevel {
+		return nil, ErrInvalidCompressionLevel
+	}
+
+	return newZStdWriter(z.CompressionLevel)
 }
 
-func (ZStdOptions) asCompressor() Compressor {
+func (ZStdOptions) AsCompressor() Compressor {
 	return CompressorZSTD
 }
 
-func (z *ZStdOptions) isDefault() bool {
-	return z.CompressionLevel == zlib.BestCompression
+func (z *ZStdOptions) IsDefault() bool {
+	return z.CompressionLevel == zstdDefaultCompressionLevel
 }
 
-func (z *ZStdOptions) writeTo(w *byteio.StickyLittleEndianWriter) {
+func (z *ZStdOptions) WriteOptions(w *byteio.StickyLittleEndianWriter) {
 	w.WriteUint32(z.CompressionLevel)
 }
@@ -0,0 +1,206 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+	"vimagination.zapto.org/byteio"
+)
+
+func TestDecompressLZMA(t *testing.T) {
+	for n, test := range [...]lzma.WriterConfig{
+		{SizeInHeader: true, Size: int64(len(contentsB)), DictCap: maxBlockSize},
+		{SizeInHeader: true, Size: int64(len(contentsB)), EOSMarker: true},
+		{EOSMarker: true, DictCap: lzma.MinDictCap},
+		{EOSMarker: true, DictCap: 1 << 26},
+	} {
+		var buf bytes.Buffer
+
+		w, err := test.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error creating lzma writer: %s", n+1, err)
+		}
+
+		io.WriteString(w, contentsB)
+		w.Close()
+
+		r, err := CompressorLZMA.decompress(&buf)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if data, err := io.ReadAll(r); err != nil {
+			t.Errorf("test %d: unexpected error reading: %s", n+1, err)
+		} else if string(data) != contentsB {
+			t.Errorf("test %d: decompressed data does not match", n+1)
+		}
+	}
+}
+
+func TestXZWriterReference(t *testing.T) {
+	random := make([]byte, 1<<13)
+
+	rand.New(rand.NewSource(0)).Read(random)
+
+	for n, dictSize := range [...]uint32{maxDictionarySize, 1 << 17, maxBlockSize} {
+		for m, data := range [...]string{"", contentsA, contentsB, contentsD, string(random)} {
+			var buf bytes.Buffer
+
+			w := newXZWriter(dictSize, 0)
+
+			w.Reset(&buf)
+			io.WriteString(w, data)
+
+			if err := w.Close(); err != nil {
+				t.Errorf("test %d.%d: unexpected error compressing: %s", n+1, m+1, err)
+
+				continue
+			}
+
+			r, err := xz.NewReader(&buf)
+			if err != nil {
+				t.Errorf("test %d.%d: unexpected error creating reader: %s", n+1, m+1, err)
+
+				continue
+			}
+
+			if got, err := io.ReadAll(r); err != nil {
+				t.Errorf("test %d.%d: unexpected error decompressing: %s", n+1, m+1, err)
+			} else if string(got) != data {
+				t.Errorf("test %d.%d: decompressed data does not match input", n+1, m+1)
+			}
+		}
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	large := make([]byte, maxBlockSize+1)
+
+	var zbuf, xbuf bytes.Buffer
+
+	zw, err := zstd.NewWriter(&zbuf)
+	if err != nil {
+		t.Fatalf("unexpected error creating zstd writer: %s", err)
+	}
+
+	zw.Write(large)
+	zw.Close()
+
+	xw, err := xz.NewWriter(&xbuf)
+	if err != nil {
+		t.Fatalf("unexpected error creating xz writer: %s", err)
+	}
+
+	xw.Write(large)
+	xw.Close()
+
+	var lbuf bytes.Buffer
+
+	lw, err := lzma.NewWriter(&lbuf)
+	if err != nil {
+		t.Fatalf("unexpected error creating lzma writer: %s", err)
+	}
+
+	lw.Write(large)
+	lw.Close()
+
+	if size := binary.LittleEndian.Uint64(lbuf.Bytes()[lzmaSizeOffset:]); size != lzmaUnknownSize {
+		t.Fatalf("expecting lzma stream of unknown size, got size %d", size)
+	}
+
+	for n, test := range [...]struct {
+		compressor Compressor
+		data       []byte
+	}{
+		{CompressorZSTD, zbuf.Bytes()},
+		{CompressorXZ, xbuf.Bytes()},
+		{CompressorLZMA, lbuf.Bytes()},
+	} {
+		r, err := test.compressor.decompress(bytes.NewReader(test.data))
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+
+		if err == nil {
+			t.Errorf("test %d: expecting error decompressing oversized block", n+1)
+		}
+	}
+}
+
+const testCompressor Compressor = 0x100
+
+type testCompressorOptions struct{}
+
+func (testCompressorOptions) AsCompressor() Compressor {
+	return testCompressor
+}
+
+func (testCompressorOptions) IsDefault() bool {
+	return true
+}
+
+func (testCompressorOptions) WriteOptions(_ *byteio.StickyLittleEndianWriter) {}
+
+func TestRegisterCompressor(t *testing.T) {
+	var reads, writes int
+
+	RegisterCompressor(testCompressor, "test", func(r io.Reader) (io.Reader, error) {
+		reads++
+
+		return zlib.NewReader(r)
+	}, func(o CompressorOptions) (CompressedWriter, error) {
+		if _, ok := o.(testCompressorOptions); !ok {
+			return nil, ErrInvalidCompressorOptions
+		}
+
+		writes++
+
+		return zlib.NewWriter(nil), nil
+	}, func(hasOptions bool, _ *byteio.StickyLittleEndianReader) (CompressorOptions, error) {
+		if hasOptions {
+			return nil, ErrNoCompressorOptions
+		}
+
+		return testCompressorOptions{}, nil
+	})
+
+	t.Cleanup(func() {
+		compressorsMu.Lock()
+		delete(compressors, testCompressor)
+		compressorsMu.Unlock()
+	})
+
+	if name := testCompressor.String(); name != "test" {
+		t.Errorf("expecting compressor name %q, got %q", "test", name)
+	}
+
+	sfs := buildAndOpen(t, func(b *Builder) error {
+		return b.File("dirA/fileB", strings.NewReader(contentsB))
+	}, Compression(testCompressorOptions{}))
+
+	if sfs.superblock.Compressor != testCompressor {
+		t.Fatalf("expecting compressor %s, got %s", testCompressor, sfs.superblock.Compressor)
+	}
+
+	if err := readSqfsFile(sfs, "dirA/fileB", contentsB); err != nil {
+		t.Fatal(err)
+	}
+
+	if writes == 0 {
+		t.Error("expecting registered writer to be used")
+	}
+
+	if reads == 0 {
+		t.Error("expecting registered decompressor to be used")
+	}
+}
@@ -0,0 +1,223 @@
+package squashfs
+
+import (
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+)
+
+// Copy adds the entry at srcPath in the src image to the image at p,
+// recursively copying the contents of directories, and preserving the
+// ownership, permissions, modification times and xattrs of each entry, and
+// any hard links between copied entries.
+//
+// When src has the same block size, compressor and compression options as the
+// image being built, data blocks are copied without being decompressed;
+// otherwise, file data is recompressed. For XZ, blocks are also copied when the
+// dictionary size of src is no larger than that of the image being built.
+//
+// Symlinks are copied, not followed.
+func (b *Builder) Copy(p string, src *SquashFS, srcPath string) error {
+	fi, err := src.resolve(srcPath, false)
+	if err == nil {
+		err = b.copyEntry(p, src, fi, make(map[uint32]string))
+	}
+
+	if err != nil {
+		return &fs.PathError{
+			Op:   "copy",
+			Path: srcPath,
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// Convert rebuilds the src image, writing the new image to dst.
+//
+// The block size, compression, modification time and export table of src are
+// kept unless overridden by the given options. All entries are copied as with
+// Builder.Copy, with data only being recompressed when the block size or
+// compression options are changed.
+func Convert(src *SquashFS, dst io.WriterAt, options ...BuildOption) error {
+	defaults := []BuildOption{
+		BlockSize(src.superblock.BlockSize),
+		Compression(src.superblock.CompressionOptions),
+		SqfsModTime(uint32(src.superblock.ModTime.Unix())),
+	}
+
+	if src.superblock.Flags&flagExportable != 0 {
+		defaults = append(defaults, ExportTable())
+	}
+
+	b, err := Create(dst, append(defaults, options...)...)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Copy(".", src, "."); err != nil {
+		return err
+	}
+
+	return b.Close()
+}
+
+func (b *Builder) copyEntry(p string, src *SquashFS, fi fs.FileInfo, links map[uint32]string) error {
+	c, ok := statCommon(fi)
+	if !ok {
+		return fs.ErrInvalid
+	}
+
+	options, err := copyOptions(src, c, xattrIndex(fi))
+	if err != nil {
+		return err
+	}
+
+	if ds, ok := fi.(dirStat); ok {
+		if err := b.setDir(p, options); err != nil {
+			return err
+		}
+
+		return b.copyDir(p, src, ds, links)
+	}
+
+	if target, ok := links[c.inode]; ok {
+		return b.Link(p, target)
+	}
+
+	links[c.inode] = p
+
+	switch fi := fi.(type) {
+	case fileStat:
+		return b.copyFile(p, src, fi, options)
+	case symlinkStat:
+		return b.Symlink(p, fi.targetPath, options...)
+	case blockStat:
+		return b.Block(p, fi.deviceNumber, options...)
+	case charStat:
+		return b.Char(p, fi.deviceNumber, options...)
+	case fifoStat:
+		return b.FIFO(p, options...)
+	case socketStat:
+		return b.Socket(p, options...)
+	}
+
+	return fs.ErrInvalid
+}
+
+func statCommon(fi fs.FileInfo) (commonStat, bool) {
+	switch fi := fi.(type) {
+	case dirStat:
+		return fi.commonStat, true
+	case fileStat:
+		return fi.commonStat, true
+	case symlinkStat:
+		return fi.commonStat, true
+	case blockStat:
+		return fi.commonStat, true
+	case charStat:
+		return fi.commonStat, true
+	case fifoStat:
+		return fi.commonStat, true
+	case socketStat:
+		return fi.commonStat, true
+	}
+
+	return commonStat{}, false
+}
+
+func copyOptions(src *SquashFS, c commonStat, index uint32) ([]InodeOption, error) {
+	xattrs, err := src.readXattrs(index)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []InodeOption{Owner(c.uid, c.gid), Mode(fs.FileMode(c.perms)), ModTime(c.mtime)}
+
+	for _, x := range xattrs {
+		options = append(options, Xattr(x.key, x.value))
+	}
+
+	return options, nil
+}
+
+func (b *Builder) copyDir(p string, src *SquashFS, ds dirStat, links map[uint32]string) error {
+	d, err := src.newDir(ds)
+	if err != nil {
+		return err
+	}
+
+	entries, err := d.readDir(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, de := range entries {
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := b.copyEntry(path.Join(p, de.Name()), src, fi, links); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) copyFile(p string, src *SquashFS, fi fileStat, options []InodeOption) error {
+	f := &file{
+		squashfs: src,
+		file:     fi,
+	}
+
+	if src.superblock.BlockSize != b.superblock.BlockSize || !compatibleCompression(src.superblock.CompressionOptions, b.superblock.CompressionOptions) {
+		return b.File(p, f, options...)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.addFile(p, options, func(stat *fileStat, h hash.Hash) ([]byte, error) {
+		if err := b.blockWriter.CopyFile(stat, f, h); err != nil {
+			return nil, err
+		} else if fi.fragIndex == fieldDisabled {
+			return nil, nil
+		}
+
+		if stat.fileSize > fi.fileSize || fi.fileSize-stat.fileSize > uint64(len(b.blockWriter.uncompressed)) {
+			return nil, ErrInvalidBlockHeader
+		}
+
+		r, err := f.getFragmentReader()
+		if err != nil {
+			return nil, err
+		}
+
+		fragment := b.blockWriter.uncompressed[:fi.fileSize-stat.fileSize]
+
+		if _, err := io.ReadFull(r, fragment); err != nil {
+			return nil, err
+		}
+
+		stat.fileSize = fi.fileSize
+
+		return fragment, nil
+	})
+}
+
+// compatibleCompression determines whether blocks compressed with the src
+// options can be read by anything reading an image with the dst options.
+func compatibleCompression(src, dst CompressorOptions) bool {
+	if s, ok := src.(*XZOptions); ok {
+		d, ok := dst.(*XZOptions)
+
+		return ok && s.DictionarySize <= d.DictionarySize
+	}
+
+	return reflect.DeepEqual(src, dst)
+}
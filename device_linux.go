@@ -0,0 +1,11 @@
+package squashfs
+
+import "syscall"
+
+func sysDeviceNumber(sys any) uint32 {
+	if st, ok := sys.(*syscall.Stat_t); ok {
+		return uint32(st.Rdev)
+	}
+
+	return 0
+}
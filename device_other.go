@@ -0,0 +1,7 @@
+//go:build !linux
+
+package squashfs
+
+func sysDeviceNumber(_ any) uint32 {
+	return 0
+}
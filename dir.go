@@ -93,10 +93,10 @@ func (d *dir) readDirEntry(ler *byteio.StickyLittleEndianReader) dirEntry {
 		ler.ReadUint32()
 
 		d.read += dirHeaderSize
-	} else {
-		d.count--
 	}
 
+	d.count--
+
 	offset := uint64(ler.ReadUint16())
 	ler.ReadInt16() // inode offset
 
@@ -104,7 +104,7 @@ func (d *dir) readDirEntry(ler *byteio.StickyLittleEndianReader) dirEntry {
 		squashfs: d.squashfs,
 		typ:      ler.ReadUint16(),
 		name:     ler.ReadString(int(ler.ReadUint16()) + 1),
-		ptr:      uint64(d.start<<metadataPointerShift) | offset,
+		ptr:      uint64(d.start)<<metadataPointerShift | offset,
 	}
 
 	d.read += dirBodySize + len(de.name)
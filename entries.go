@@ -4,18 +4,22 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"slices"
 	"time"
 
 	"vimagination.zapto.org/byteio"
 )
 
 type commonStat struct {
-	name  string
-	perms uint16
-	uid   uint32
-	gid   uint32
-	mtime time.Time
-	inode uint32
+	name     string
+	perms    uint16
+	uid      uint32
+	gid      uint32
+	mtime    time.Time
+	inode    uint32
+	uidIndex uint16
+	gidIndex uint16
+	xattrs   []xattr
 }
 
 func (c commonStat) Name() string {
@@ -38,10 +42,14 @@ func (c commonStat) IsDir() bool {
 	return false
 }
 
+func (c *commonStat) common() *commonStat {
+	return c
+}
+
 func (c commonStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
 	lew.WriteUint16(c.perms)
-	lew.WriteUint16(uint16(c.uid))
-	lew.WriteUint16(uint16(c.gid))
+	lew.WriteUint16(c.uidIndex)
+	lew.WriteUint16(c.gidIndex)
 	lew.WriteUint32(uint32(c.mtime.Unix()))
 	lew.WriteUint32(c.inode)
 }
@@ -65,6 +73,7 @@ const (
 	fieldDisabled = 0xffffffff
 
 	idLength = 4
+	maxIDs   = 0xffff
 )
 
 type dirIndex struct {
@@ -153,6 +162,14 @@ func (d dirStat) String() string {
 	return fs.FormatFileInfo(d)
 }
 
+func (d *dirStat) setLinkCount(linkCount uint32) {
+	d.linkCount = linkCount
+}
+
+func (d *dirStat) setXattrIndex(index uint32) {
+	d.xattrIndex = index
+}
+
 func (d dirStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
 	if d.xattrIndex != fieldDisabled || len(d.index) > 0 || d.fileSize > 0xffff {
 		d.writeExtTo(lew)
@@ -199,6 +216,12 @@ type fileStat struct {
 	blockSizes  []uint32
 }
 
+func (f *fileStat) addHole(length uint64) {
+	f.fileSize += length
+	f.sparse += length
+	f.blockSizes = append(f.blockSizes, 0)
+}
+
 func (f *fileStat) readBlocks(ler *byteio.StickyLittleEndianReader, blockSize uint32) {
 	var blockCount uint64
 
@@ -224,6 +247,7 @@ func readBasicFile(ler *byteio.StickyLittleEndianReader, common commonStat, bloc
 		fragIndex:   ler.ReadUint32(),
 		blockOffset: ler.ReadUint32(),
 		fileSize:    uint64(ler.ReadUint32()),
+		linkCount:   1,
 		xattrIndex:  fieldDisabled,
 	}
 
@@ -265,8 +289,16 @@ func (f fileStat) String() string {
 	return fs.FormatFileInfo(f)
 }
 
+func (f *fileStat) setLinkCount(linkCount uint32) {
+	f.linkCount = linkCount
+}
+
+func (f *fileStat) setXattrIndex(index uint32) {
+	f.xattrIndex = index
+}
+
 func (f fileStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
-	if f.blocksStart > 0xffffffff || f.fileSize > 0xffffffff || f.linkCount > 0 || f.xattrIndex != fieldDisabled || f.sparse > 0 {
+	if f.blocksStart > 0xffffffff || f.fileSize > 0xffffffff || f.linkCount > 1 || f.xattrIndex != fieldDisabled || f.sparse > 0 {
 		f.writeExtTo(lew)
 	} else {
 		f.writeBasicTo(lew)
@@ -339,6 +371,14 @@ func (s symlinkStat) String() string {
 	return fs.FormatFileInfo(s)
 }
 
+func (s *symlinkStat) setLinkCount(linkCount uint32) {
+	s.linkCount = linkCount
+}
+
+func (s *symlinkStat) setXattrIndex(index uint32) {
+	s.xattrIndex = index
+}
+
 func (s symlinkStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
 	if s.xattrIndex != fieldDisabled {
 		s.writeExtTo(lew)
@@ -399,6 +439,14 @@ func (b blockStat) String() string {
 	return fs.FormatFileInfo(b)
 }
 
+func (b *blockStat) setLinkCount(linkCount uint32) {
+	b.linkCount = linkCount
+}
+
+func (b *blockStat) setXattrIndex(index uint32) {
+	b.xattrIndex = index
+}
+
 func (b blockStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
 	if b.xattrIndex != fieldDisabled {
 		b.writeExtTo(lew)
@@ -436,6 +484,14 @@ func (c charStat) String() string {
 	return fs.FormatFileInfo(c)
 }
 
+func (c *charStat) setLinkCount(linkCount uint32) {
+	c.linkCount = linkCount
+}
+
+func (c *charStat) setXattrIndex(index uint32) {
+	c.xattrIndex = index
+}
+
 func (c charStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
 	if c.xattrIndex != fieldDisabled {
 		c.writeExtTo(lew)
@@ -493,6 +549,14 @@ func (f fifoStat) String() string {
 	return fs.FormatFileInfo(f)
 }
 
+func (f *fifoStat) setLinkCount(linkCount uint32) {
+	f.linkCount = linkCount
+}
+
+func (f *fifoStat) setXattrIndex(index uint32) {
+	f.xattrIndex = index
+}
+
 func (f fifoStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
 	if f.xattrIndex != fieldDisabled {
 		f.writeExtTo(lew)
@@ -528,6 +592,14 @@ func (s socketStat) String() string {
 	return fs.FormatFileInfo(s)
 }
 
+func (s *socketStat) setLinkCount(linkCount uint32) {
+	s.linkCount = linkCount
+}
+
+func (s *socketStat) setXattrIndex(index uint32) {
+	s.xattrIndex = index
+}
+
 func (s socketStat) writeTo(lew *byteio.StickyLittleEndianWriter) {
 	if s.xattrIndex != fieldDisabled {
 		s.writeExtTo(lew)
@@ -635,13 +707,26 @@ func (s *SquashFS) getID(ler *byteio.StickyLittleEndianReader) uint32 {
 	return pid
 }
 
-func (s *SquashFS) getDirEntry(name string, index uint32, offset uint16, totalSize uint32) (fs.FileInfo, error) {
-	r, err := s.readMetadata(uint64(index)<<metadataPointerShift|uint64(offset), s.superblock.DirTable)
+func (s *SquashFS) getDirEntry(name string, parent dirStat) (fs.FileInfo, error) {
+	start, offset, read := parent.blockIndex, uint32(parent.blockOffset), uint32(0)
+
+	if n, _ := slices.BinarySearchFunc(parent.index, name, func(i dirIndex, name string) int {
+		if i.name <= name {
+			return -1
+		}
+
+		return 1
+	}); n > 0 {
+		i := parent.index[n-1]
+		start, offset, read = i.start, (offset+i.index)%blockSize, i.index
+	}
+
+	r, err := s.readMetadata(uint64(start)<<metadataPointerShift|uint64(offset), s.superblock.DirTable)
 	if err != nil {
 		return nil, err
 	}
 
-	ler := byteio.StickyLittleEndianReader{Reader: io.LimitReader(r, int64(totalSize-dirFileSizeOffset))}
+	ler := byteio.StickyLittleEndianReader{Reader: io.LimitReader(r, int64(parent.fileSize-dirFileSizeOffset-read))}
 
 	d := dir{
 		squashfs: s,
@@ -14,6 +14,13 @@ var (
 	ErrInvalidCompressorVersion     = errors.New("invalid compressor version")
 	ErrInvalidCompressorFlags       = errors.New("invalid compressor flags")
 	ErrUnsupportedCompressor        = errors.New("unsupported compressor")
+	ErrInvalidCompressorOptions     = errors.New("invalid compressor options")
+	ErrInvalidXZStream              = errors.New("invalid xz stream")
+	ErrUnsupportedXZFilter          = errors.New("unsupported xz filter")
+	ErrInvalidChecksum              = errors.New("invalid checksum")
+	ErrInvalidLZ4Block              = errors.New("invalid lz4 block")
+	ErrInvalidLZOBlock              = errors.New("invalid lzo block")
+	ErrInvalidLZMAHeader            = errors.New("invalid lzma header")
 
 	ErrInvalidPointer     = errors.New("invalid pointer")
 	ErrInvalidBlockHeader = errors.New("invalid block header")
@@ -21,4 +28,17 @@ var (
 	ErrInvalidMagicNumber = errors.New("invalid magic number")
 	ErrInvalidBlockSize   = errors.New("invalid block size")
 	ErrInvalidVersion     = errors.New("invalid version")
+
+	ErrTooManyIDs             = errors.New("too many unique ids")
+	ErrInvalidWorkerCount     = errors.New("invalid worker count")
+	ErrInvalidSourceDateEpoch = errors.New("invalid SOURCE_DATE_EPOCH")
+
+	ErrNoExportTable     = errors.New("no export table")
+	ErrIncompatibleImage = errors.New("options incompatible with existing image")
+
+	ErrNoXattr      = errors.New("no such xattr")
+	ErrInvalidXattr = errors.New("invalid xattr")
+
+	ErrInvalidPseudo   = errors.New("invalid pseudo definition")
+	ErrNoPseudoCommand = errors.New("no data for pseudo file command")
 )
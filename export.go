@@ -0,0 +1,68 @@
+package squashfs
+
+import (
+	"io/fs"
+	"strconv"
+
+	"vimagination.zapto.org/byteio"
+)
+
+// StatInode returns a FileInfo describing the file with the given inode
+// number.
+//
+// Requires that the image was built with an export table. As the file is not
+// looked up by path, the returned FileInfo will have an empty name.
+func (s *SquashFS) StatInode(inode uint32) (fs.FileInfo, error) {
+	fi, err := s.statInode(inode)
+	if err != nil {
+		return nil, inodeError("statinode", inode, err)
+	}
+
+	return fi, nil
+}
+
+// OpenInode opens the file with the given inode number for reading.
+//
+// Requires that the image was built with an export table.
+func (s *SquashFS) OpenInode(inode uint32) (fs.File, error) {
+	fi, err := s.statInode(inode)
+	if err == nil {
+		var f fs.File
+
+		if f, err = s.openEntry(fi); err == nil {
+			return f, nil
+		}
+	}
+
+	return nil, inodeError("openinode", inode, err)
+}
+
+func inodeError(op string, inode uint32, err error) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: strconv.FormatUint(uint64(inode), 10),
+		Err:  err,
+	}
+}
+
+func (s *SquashFS) statInode(inode uint32) (fs.FileInfo, error) {
+	if s.superblock.ExportTable == noTable {
+		return nil, ErrNoExportTable
+	} else if inode == 0 || inode > s.superblock.Inodes {
+		return nil, fs.ErrNotExist
+	}
+
+	r, err := s.readMetadataFromLookupTable(int64(s.superblock.ExportTable), int64(inode-1), exportLength)
+	if err != nil {
+		return nil, err
+	}
+
+	ler := byteio.StickyLittleEndianReader{Reader: r}
+	ref := ler.ReadUint64()
+
+	if ler.Err != nil {
+		return nil, ler.Err
+	}
+
+	return s.getEntry(ref, "")
+}
@@ -123,6 +123,9 @@ func (f *file) getBlockReader(block int) (io.ReadSeeker, error) {
 	}
 
 	size := int64(f.file.blockSizes[block])
+	if size&sizeMask == 0 {
+		return io.NewSectionReader(zeroReader{}, 0, f.blockLength(block)), nil
+	}
 
 	var c Compressor
 	if size&compressionMask == 0 {
@@ -134,6 +137,20 @@ func (f *file) getBlockReader(block int) (io.ReadSeeker, error) {
 	return f.squashfs.blockCache.getBlock(start, r, c)
 }
 
+func (f *file) blockLength(block int) int64 {
+	blockSize := int64(f.squashfs.superblock.BlockSize)
+
+	return min(blockSize, int64(f.file.fileSize)-int64(block)*blockSize)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) ReadAt(p []byte, _ int64) (int, error) {
+	clear(p)
+
+	return len(p), nil
+}
+
 func (f *file) getFragmentDetails() (start uint64, size uint32, err error) {
 	r, err := f.squashfs.readMetadataFromLookupTable(int64(f.squashfs.superblock.FragTable), int64(f.file.fragIndex), fragmentDetailSize)
 	ler := byteio.StickyLittleEndianReader{
@@ -2,8 +2,11 @@ module vimagination.zapto.org/squashfs
 
 go 1.22.2
 
+require github.com/klauspost/compress v1.18.0
+
+require github.com/ulikunitz/xz v0.5.15
+
 require vimagination.zapto.org/byteio v1.0.5
 
 require vimagination.zapto.org/memio v1.1.0
 
-require vimagination.zapto.org/rwcount v1.1.1 // indirect
@@ -0,0 +1,213 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"vimagination.zapto.org/memio"
+)
+
+const (
+	lz4Version = 1
+	lz4FlagHC  = 1
+
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+	lz4MaxOffset    = 0xffff
+	lz4LengthMask   = 0xf
+	lz4HashLog      = 16
+
+	lz4FastAttempts = 1
+	lz4HCAttempts   = 256
+)
+
+func decompressLZ4(r io.Reader) (io.Reader, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := lz4Decode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(dst), nil
+}
+
+func lz4Decode(src []byte) ([]byte, error) {
+	var (
+		dst                   []byte
+		pos, litLen, matchLen int
+		err                   error
+	)
+
+	for pos < len(src) {
+		token := src[pos]
+		pos++
+
+		if litLen, pos, err = lz4ReadLength(src, pos, int(token>>4)); err != nil {
+			return nil, err
+		} else if len(src)-pos < litLen {
+			return nil, ErrInvalidLZ4Block
+		}
+
+		dst = append(dst, src[pos:pos+litLen]...)
+		pos += litLen
+
+		if pos == len(src) {
+			return dst, nil
+		} else if len(src)-pos < 2 {
+			return nil, ErrInvalidLZ4Block
+		}
+
+		offset := int(binary.LittleEndian.Uint16(src[pos:]))
+		pos += 2
+
+		if offset == 0 || offset > len(dst) {
+			return nil, ErrInvalidLZ4Block
+		}
+
+		if matchLen, pos, err = lz4ReadLength(src, pos, int(token&lz4LengthMask)); err != nil {
+			return nil, err
+		}
+
+		matchLen += lz4MinMatch
+
+		if len(dst)+matchLen > maxBlockSize {
+			return nil, ErrInvalidLZ4Block
+		}
+
+		for start := len(dst) - offset; matchLen > 0; matchLen-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+
+	return nil, ErrInvalidLZ4Block
+}
+
+func lz4ReadLength(src []byte, pos, length int) (int, int, error) {
+	if length != lz4LengthMask {
+		return length, pos, nil
+	}
+
+	for {
+		if pos >= len(src) {
+			return 0, 0, ErrInvalidLZ4Block
+		}
+
+		b := src[pos]
+		pos++
+		length += int(b)
+
+		if b != 0xff {
+			return length, pos, nil
+		}
+	}
+}
+
+type lz4Writer struct {
+	w        io.Writer
+	buf      memio.Buffer
+	attempts int
+}
+
+func newLZ4Writer(hc bool) *lz4Writer {
+	if hc {
+		return &lz4Writer{attempts: lz4HCAttempts}
+	}
+
+	return &lz4Writer{attempts: lz4FastAttempts}
+}
+
+func (l *lz4Writer) Reset(w io.Writer) {
+	l.w = w
+	l.buf = l.buf[:0]
+}
+
+func (l *lz4Writer) Write(p []byte) (int, error) {
+	return l.buf.Write(p)
+}
+
+func (l *lz4Writer) Close() error {
+	_, err := l.w.Write(lz4Encode(l.buf, l.attempts))
+
+	return err
+}
+
+func lz4Encode(src []byte, attempts int) []byte {
+	m := newLZMatcher(src, len(src)-lz4LastLiterals, lz4MaxOffset, lz4HashLog, attempts)
+
+	var (
+		out    []byte
+		anchor int
+	)
+
+	limit := len(src) - lz4MFLimit
+
+	for pos := 0; pos < limit; {
+		matchPos, matchLen := m.find(pos)
+		if matchLen < lz4MinMatch {
+			pos++
+
+			continue
+		}
+
+		for m.chain != nil && pos+1 < limit {
+			nextPos, nextLen := m.find(pos + 1)
+			if nextLen <= matchLen {
+				break
+			}
+
+			pos, matchPos, matchLen = pos+1, nextPos, nextLen
+		}
+
+		for pos > anchor && matchPos > 0 && src[pos-1] == src[matchPos-1] {
+			pos--
+			matchPos--
+			matchLen++
+		}
+
+		out = lz4AppendSequence(out, src[anchor:pos], pos-matchPos, matchLen)
+		pos += matchLen
+		anchor = pos
+	}
+
+	return lz4AppendSequence(out, src[anchor:], 0, 0)
+}
+
+func lz4AppendSequence(out, literals []byte, offset, matchLen int) []byte {
+	token := len(out)
+	out = append(out, byte(min(len(literals), lz4LengthMask))<<4)
+
+	if len(literals) >= lz4LengthMask {
+		out = lz4AppendLength(out, len(literals)-lz4LengthMask)
+	}
+
+	out = append(out, literals...)
+
+	if matchLen == 0 {
+		return out
+	}
+
+	out = binary.LittleEndian.AppendUint16(out, uint16(offset))
+	matchLen -= lz4MinMatch
+	out[token] |= byte(min(matchLen, lz4LengthMask))
+
+	if matchLen >= lz4LengthMask {
+		out = lz4AppendLength(out, matchLen-lz4LengthMask)
+	}
+
+	return out
+}
+
+func lz4AppendLength(out []byte, n int) []byte {
+	for ; n >= 0xff; n -= 0xff {
+		out = append(out, 0xff)
+	}
+
+	return append(out, byte(n))
+}
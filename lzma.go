@@ -0,0 +1,45 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	lzmaDictSizeOffset = 1
+	lzmaSizeOffset     = 5
+	lzmaUnknownSize    = 0xffffffffffffffff
+)
+
+func decompressLZMA(r io.Reader) (io.Reader, error) {
+	var header [lzma.HeaderLen]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if size := binary.LittleEndian.Uint64(header[lzmaSizeOffset:]); size != lzmaUnknownSize && size > maxBlockSize {
+		return nil, ErrInvalidLZMAHeader
+	}
+
+	dictSize := binary.LittleEndian.Uint32(header[lzmaDictSizeOffset:])
+
+	binary.LittleEndian.PutUint32(header[lzmaDictSizeOffset:], min(dictSize, maxBlockSize))
+
+	lr, err := lzma.ReaderConfig{DictCap: maxBlockSize}.NewReader(io.MultiReader(bytes.NewReader(header[:]), r))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(lr, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxBlockSize {
+		return nil, ErrInvalidLZMAHeader
+	}
+
+	return bytes.NewReader(data), nil
+}
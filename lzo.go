@@ -0,0 +1,320 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"vimagination.zapto.org/memio"
+)
+
+const (
+	lzoAlgorithm1X1   = 0
+	lzoAlgorithm1X11  = 1
+	lzoAlgorithm1X12  = 2
+	lzoAlgorithm1X15  = 3
+	lzoAlgorithm1X999 = 4
+
+	lzoMinMatch      = 4
+	lzoMaxOffset     = 0xbfff
+	lzoM2MaxLength   = 8
+	lzoM2MaxOffset   = 0x0800
+	lzoM3MaxLength   = 33
+	lzoM3MaxOffset   = 0x4000
+	lzoM4MaxLength   = 9
+	lzoM4Marker      = 0x10
+	lzoM3Marker      = 0x20
+	lzoM2Marker      = 0x40
+	lzoM1Offset      = 0x0801
+	lzoFirstLiterals = 17
+	lzoMaxFirstRun   = 0xff - lzoFirstLiterals
+	lzoMaxShortRun   = 18
+	lzo999HashLog    = 16
+)
+
+var (
+	lzoHashLogs    = [...]uint{lzoAlgorithm1X1: 14, lzoAlgorithm1X11: 11, lzoAlgorithm1X12: 12, lzoAlgorithm1X15: 15}
+	lzo999Attempts = [...]int{4, 4, 8, 16, 32, 64, 128, 256, 1024, 4096}
+	lzoEndMarker   = [...]byte{lzoM4Marker | 1, 0, 0}
+)
+
+func decompressLZO(r io.Reader) (io.Reader, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := lzoDecode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(dst), nil
+}
+
+func lzoDecode(src []byte) ([]byte, error) {
+	var (
+		dst                          []byte
+		pos, state, length, literals int
+		err                          error
+	)
+
+	if len(src) > 0 && src[0] > lzoFirstLiterals {
+		length = int(src[0] - lzoFirstLiterals)
+		pos = 1
+
+		if dst, pos, err = lzoCopyLiterals(dst, src, pos, length); err != nil {
+			return nil, err
+		}
+
+		state = min(length, 4)
+	}
+
+	for {
+		if pos >= len(src) {
+			return nil, ErrInvalidLZOBlock
+		}
+
+		instr := src[pos]
+		pos++
+
+		var distance int
+
+		switch {
+		case instr >= lzoM2Marker:
+			if pos >= len(src) {
+				return nil, ErrInvalidLZOBlock
+			}
+
+			length = int(instr>>5) + 1
+			distance = int(src[pos])<<3 + int(instr>>2&7) + 1
+			literals = int(instr & 3)
+			pos++
+		case instr >= lzoM3Marker:
+			if length, pos, err = lzoReadLength(src, pos, int(instr&0x1f), 0x1f); err != nil {
+				return nil, err
+			} else if len(src)-pos < 2 {
+				return nil, ErrInvalidLZOBlock
+			}
+
+			le := int(binary.LittleEndian.Uint16(src[pos:]))
+			length += 2
+			distance = le>>2 + 1
+			literals = le & 3
+			pos += 2
+		case instr >= lzoM4Marker:
+			if length, pos, err = lzoReadLength(src, pos, int(instr&7), 7); err != nil {
+				return nil, err
+			} else if len(src)-pos < 2 {
+				return nil, ErrInvalidLZOBlock
+			}
+
+			le := int(binary.LittleEndian.Uint16(src[pos:]))
+			length += 2
+			distance = lzoM3MaxOffset + int(instr&8)<<11 + le>>2
+			literals = le & 3
+			pos += 2
+
+			if distance == lzoM3MaxOffset {
+				if pos != len(src) {
+					return nil, ErrInvalidLZOBlock
+				}
+
+				return dst, nil
+			}
+		case state == 0:
+			if length, pos, err = lzoReadLength(src, pos, int(instr), 0xf); err != nil {
+				return nil, err
+			}
+
+			if dst, pos, err = lzoCopyLiterals(dst, src, pos, length+3); err != nil {
+				return nil, err
+			}
+
+			state = 4
+
+			continue
+		default:
+			if pos >= len(src) {
+				return nil, ErrInvalidLZOBlock
+			}
+
+			length = 2
+			distance = int(src[pos])<<2 + int(instr>>2) + 1
+			literals = int(instr & 3)
+			pos++
+
+			if state == 4 {
+				length = 3
+				distance += lzoM1Offset - 1
+			}
+		}
+
+		if distance > len(dst) || len(dst)+length > maxBlockSize {
+			return nil, ErrInvalidLZOBlock
+		}
+
+		for start := len(dst) - distance; length > 0; length-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+
+		if dst, pos, err = lzoCopyLiterals(dst, src, pos, literals); err != nil {
+			return nil, err
+		}
+
+		state = literals
+	}
+}
+
+func lzoReadLength(src []byte, pos, length, mask int) (int, int, error) {
+	if length != 0 {
+		return length, pos, nil
+	}
+
+	for length = mask; ; length += 0xff {
+		if pos >= len(src) {
+			return 0, 0, ErrInvalidLZOBlock
+		}
+
+		b := src[pos]
+		pos++
+
+		if b != 0 {
+			return length + int(b), pos, nil
+		}
+	}
+}
+
+func lzoCopyLiterals(dst, src []byte, pos, length int) ([]byte, int, error) {
+	if len(src)-pos < length || len(dst)+length > maxBlockSize {
+		return nil, 0, ErrInvalidLZOBlock
+	}
+
+	return append(dst, src[pos:pos+length]...), pos + length, nil
+}
+
+type lzoWriter struct {
+	w        io.Writer
+	buf      memio.Buffer
+	hashLog  uint
+	attempts int
+}
+
+func newLZOWriter(algorithm, level uint32) *lzoWriter {
+	if algorithm == lzoAlgorithm1X999 {
+		return &lzoWriter{hashLog: lzo999HashLog, attempts: lzo999Attempts[level]}
+	}
+
+	return &lzoWriter{hashLog: lzoHashLogs[algorithm], attempts: 1}
+}
+
+func (l *lzoWriter) Reset(w io.Writer) {
+	l.w = w
+	l.buf = l.buf[:0]
+}
+
+func (l *lzoWriter) Write(p []byte) (int, error) {
+	return l.buf.Write(p)
+}
+
+func (l *lzoWriter) Close() error {
+	_, err := l.w.Write(lzoEncode(l.buf, l.hashLog, l.attempts))
+
+	return err
+}
+
+func lzoEncode(src []byte, hashLog uint, attempts int) []byte {
+	m := newLZMatcher(src, len(src), lzoMaxOffset, hashLog, attempts)
+
+	var (
+		out    []byte
+		anchor int
+	)
+
+	for pos := 0; pos+lzoMinMatch <= len(src); {
+		matchPos, matchLen := m.find(pos)
+		if matchLen < lzoMinMatch {
+			pos++
+
+			continue
+		}
+
+		for m.chain != nil && pos+1+lzoMinMatch <= len(src) {
+			nextPos, nextLen := m.find(pos + 1)
+			if nextLen <= matchLen {
+				break
+			}
+
+			pos, matchPos, matchLen = pos+1, nextPos, nextLen
+		}
+
+		for pos > anchor && matchPos > 0 && src[pos-1] == src[matchPos-1] {
+			pos--
+			matchPos--
+			matchLen++
+		}
+
+		out = lzoAppendLiterals(out, src[anchor:pos])
+		out = lzoAppendMatch(out, pos-matchPos, matchLen)
+		pos += matchLen
+		anchor = pos
+	}
+
+	out = lzoAppendLiterals(out, src[anchor:])
+
+	return append(out, lzoEndMarker[:]...)
+}
+
+func lzoAppendLiterals(out, literals []byte) []byte {
+	switch length := len(literals); {
+	case length == 0:
+		return out
+	case len(out) == 0 && length <= lzoMaxFirstRun:
+		out = append(out, byte(lzoFirstLiterals+length))
+	case length <= 3:
+		out[len(out)-2] |= byte(length)
+	case length <= lzoMaxShortRun:
+		out = append(out, byte(length-3))
+	default:
+		out = lzoAppendLength(append(out, 0), length-lzoMaxShortRun)
+	}
+
+	return append(out, literals...)
+}
+
+func lzoAppendMatch(out []byte, distance, length int) []byte {
+	switch {
+	case length <= lzoM2MaxLength && distance <= lzoM2MaxOffset:
+		distance--
+
+		return append(out, byte(length-1)<<5|byte(distance&7)<<2, byte(distance>>3))
+	case distance <= lzoM3MaxOffset:
+		distance--
+
+		if length <= lzoM3MaxLength {
+			out = append(out, lzoM3Marker|byte(length-2))
+		} else {
+			out = lzoAppendLength(append(out, lzoM3Marker), length-lzoM3MaxLength)
+		}
+	default:
+		distance -= lzoM3MaxOffset
+		marker := lzoM4Marker | byte(distance>>11)&8
+
+		if length <= lzoM4MaxLength {
+			out = append(out, marker|byte(length-2))
+		} else {
+			out = lzoAppendLength(append(out, marker), length-lzoM4MaxLength)
+		}
+	}
+
+	return append(out, byte(distance<<2), byte(distance>>6))
+}
+
+func lzoAppendLength(out []byte, n int) []byte {
+	for ; n > 0xff; n -= 0xff {
+		out = append(out, 0)
+	}
+
+	return append(out, byte(n))
+}
@@ -11,7 +11,10 @@ import (
 	"time"
 )
 
-var checkSQFSTar = func(_ *testing.T) {}
+var (
+	checkSQFSTar    = func(_ *testing.T) {}
+	checkUnsquashfs = func(_ *testing.T) {}
+)
 
 func TestMain(m *testing.M) {
 	_, err := exec.LookPath("sqfstar")
@@ -19,6 +22,10 @@ func TestMain(m *testing.M) {
 		checkSQFSTar = (*testing.T).SkipNow
 	}
 
+	if _, err = exec.LookPath("unsquashfs"); err != nil {
+		checkUnsquashfs = (*testing.T).SkipNow
+	}
+
 	os.Exit(m.Run())
 }
 
@@ -43,6 +50,17 @@ func owner(uid, gid int) option {
 	}
 }
 
+func setXattr(key, value string) option {
+	return func(h *tar.Header) {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+
+		h.PAXRecords["SCHILY.xattr."+key] = value
+		h.Format = tar.FormatPAX
+	}
+}
+
 type directory struct {
 	tar.Header
 	children []child
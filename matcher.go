@@ -0,0 +1,84 @@
+package squashfs
+
+import "encoding/binary"
+
+type lzMatcher struct {
+	src       []byte
+	head      []int32
+	chain     []int32
+	next      int
+	end       int
+	window    int
+	hashShift uint
+	attempts  int
+}
+
+func newLZMatcher(src []byte, end, window int, hashLog uint, attempts int) *lzMatcher {
+	m := &lzMatcher{
+		src:       src,
+		head:      make([]int32, 1<<hashLog),
+		end:       end,
+		window:    window,
+		hashShift: 32 - hashLog,
+		attempts:  attempts,
+	}
+
+	if attempts > 1 {
+		m.chain = make([]int32, len(src))
+	}
+
+	return m
+}
+
+func (m *lzMatcher) hash(pos int) uint32 {
+	return (binary.LittleEndian.Uint32(m.src[pos:]) * 2654435761) >> m.hashShift
+}
+
+func (m *lzMatcher) insertTo(pos int) {
+	for ; m.next < pos; m.next++ {
+		h := m.hash(m.next)
+
+		if m.chain != nil {
+			m.chain[m.next] = m.head[h]
+		}
+
+		m.head[h] = int32(m.next + 1)
+	}
+}
+
+func (m *lzMatcher) find(pos int) (int, int) {
+	m.insertTo(pos)
+
+	var bestPos, bestLen int
+
+	for cand, attempts := m.head[m.hash(pos)], m.attempts; cand > 0 && attempts > 0; attempts-- {
+		c := int(cand - 1)
+		if pos-c > m.window {
+			break
+		}
+
+		if l := m.matchLength(c, pos); l > bestLen {
+			bestPos, bestLen = c, l
+		}
+
+		if m.chain == nil {
+			break
+		}
+
+		cand = m.chain[c]
+	}
+
+	m.insertTo(pos + 1)
+
+	return bestPos, bestLen
+}
+
+func (m *lzMatcher) matchLength(a, b int) int {
+	var n int
+
+	for b+n < m.end && m.src[a+n] == m.src[b+n] {
+		n++
+	}
+
+	return n
+}
@@ -17,8 +17,7 @@ const (
 	metadataBlockSizeMask       = 0x7fff
 	metadataBlockCompressedMask = 0x8000
 
-	lookupMDShift = 10
-	lookupMDLen   = 8
+	lookupMDLen = 8
 )
 
 func (s *SquashFS) readMetadata(pointer, table uint64) (*blockReader, error) {
@@ -42,7 +41,7 @@ func (s *SquashFS) readMetadata(pointer, table uint64) (*blockReader, error) {
 }
 
 func (s *SquashFS) readMetadataFromLookupTable(table, index int64, size uint64) (*blockReader, error) {
-	ptr := table + index>>lookupMDShift
+	ptr := table + int64(uint64(index)*size/blockSize)*lookupMDLen
 	ler := byteio.LittleEndianReader{
 		Reader: io.NewSectionReader(s.reader, ptr, lookupMDLen),
 	}
@@ -87,7 +86,7 @@ func (b *blockReader) nextReader() error {
 		return err
 	}
 
-	b.next += size
+	b.next += blockHeaderSize + size
 
 	return nil
 }
@@ -0,0 +1,161 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// AddOCILayers applies the given OCI image layers, each an uncompressed tar
+// stream, in order, flattening them into the image.
+//
+// Entries in a layer replace any entry at the same path from earlier layers,
+// ".wh." whiteout files remove the named entry from earlier layers, and
+// ".wh..wh..opq" markers remove all entries from earlier layers in the
+// directory containing them.
+func (b *Builder) AddOCILayers(layers ...io.Reader) error {
+	for _, layer := range layers {
+		l := ociLayer{
+			Builder: b,
+			added:   make(map[childNode]struct{}),
+		}
+
+		if err := l.apply(layer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type ociLayer struct {
+	*Builder
+	added map[childNode]struct{}
+}
+
+func (l *ociLayer) apply(r io.Reader) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err = l.applyEntry(hdr, tr); err != nil {
+			return &fs.PathError{
+				Op:   "addocilayers",
+				Path: hdr.Name,
+				Err:  err,
+			}
+		}
+	}
+}
+
+func (l *ociLayer) applyEntry(hdr *tar.Header, r io.Reader) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+
+	p := tarPath("", hdr.Name)
+	dir, name := path.Dir(p), path.Base(p)
+
+	if name == whiteoutOpaque {
+		l.opaque(dir)
+
+		return nil
+	} else if target, ok := strings.CutPrefix(name, whiteoutPrefix); ok {
+		l.whiteout(dir, target)
+
+		return nil
+	}
+
+	l.replace(p, hdr.Typeflag == tar.TypeDir)
+
+	if err := l.addTarEntry("", hdr, r); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c := l.root.getNode(p); c != nil {
+		l.added[c] = struct{}{}
+	}
+
+	return nil
+}
+
+func (l *ociLayer) getDir(p string) *dirNode {
+	if p == "." {
+		return l.root
+	} else if c := l.root.getNode(p); c != nil {
+		return c.AsDir()
+	}
+
+	return nil
+}
+
+func (l *ociLayer) replace(p string, isDir bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := l.getDir(path.Dir(p))
+	if d == nil {
+		return
+	}
+
+	if pos, exists := d.find(path.Base(p)); exists && (!isDir || d.children[pos].AsDir() == nil) {
+		d.removeNode(pos)
+	}
+}
+
+func (l *ociLayer) whiteout(dir, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d := l.getDir(dir)
+	if d == nil {
+		return
+	}
+
+	if pos, exists := d.find(name); exists {
+		if _, added := l.added[d.children[pos]]; !added {
+			d.removeNode(pos)
+		}
+	}
+}
+
+func (l *ociLayer) opaque(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if d := l.getDir(dir); d != nil {
+		l.removeLower(d)
+	}
+}
+
+func (l *ociLayer) removeLower(d *dirNode) {
+	for pos := len(d.children) - 1; pos >= 0; pos-- {
+		c := d.children[pos]
+		cd := c.AsDir()
+
+		if cd != nil {
+			l.removeLower(cd)
+		}
+
+		if _, added := l.added[c]; !added && (cd == nil || len(cd.children) == 0) {
+			d.removeNode(pos)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package squashfs
 import (
 	"io/fs"
 	"math/bits"
+	"os"
+	"slices"
+	"strconv"
 	"time"
 )
 
@@ -10,6 +13,8 @@ const (
 	minBlockSize     = 1 << 12 // 4K
 	defaultBlockSize = 1 << 17 // 128K
 	maxBlockSize     = 1 << 20 // 1MB
+
+	defaultPerms = 0o755
 )
 
 type BuildOption func(*Builder) error
@@ -41,7 +46,7 @@ func Compression(c CompressorOptions) BuildOption {
 
 		b.superblock.CompressionOptions = c
 
-		if c.isDefault() {
+		if c.IsDefault() {
 			b.superblock.Flags &= ^uint16(flagCompressionOptions)
 		} else {
 			b.superblock.Flags |= flagCompressionOptions
@@ -53,7 +58,35 @@ func Compression(c CompressorOptions) BuildOption {
 
 func ExportTable() BuildOption {
 	return func(b *Builder) error {
-		b.superblock.Stats.Flags |= 0x80
+		b.superblock.Stats.Flags |= flagExportable
+
+		return nil
+	}
+}
+
+// NoDeduplication disables the detection of duplicate file data and
+// fragments, which are otherwise only written once.
+func NoDeduplication() BuildOption {
+	return func(b *Builder) error {
+		b.dedup = false
+
+		return nil
+	}
+}
+
+// CompressionWorkers sets the number of goroutines that will be used to
+// concurrently compress data and fragment blocks.
+//
+// By default, blocks are compressed one at a time by the goroutine adding the
+// file. The worker goroutines are stopped by Builder.Close, which must be
+// called even if building the image fails.
+func CompressionWorkers(n int) BuildOption {
+	return func(b *Builder) error {
+		if n < 1 {
+			return ErrInvalidWorkerCount
+		}
+
+		b.workers = n
 
 		return nil
 	}
@@ -67,6 +100,42 @@ func SqfsModTime(t uint32) BuildOption {
 	}
 }
 
+// Reproducible sets the superblock modification time to the given time and
+// clamps the modification time of any inode later than it.
+//
+// Along with inode numbers being assigned in sorted tree order, and data
+// being written in the order files are added, regardless of the number of
+// compression workers, this allows identical input to produce identical
+// images.
+func Reproducible(t time.Time) BuildOption {
+	return func(b *Builder) error {
+		b.superblock.Stats.ModTime = time.Unix(t.Unix(), 0)
+		b.clampTime = b.superblock.Stats.ModTime
+
+		return nil
+	}
+}
+
+// SourceDateEpoch enables Reproducible mode using the time, in seconds since
+// the Unix epoch, stored in the SOURCE_DATE_EPOCH environment variable.
+//
+// If the variable is unset or empty, this option does nothing.
+func SourceDateEpoch() BuildOption {
+	return func(b *Builder) error {
+		epoch := os.Getenv("SOURCE_DATE_EPOCH")
+		if epoch == "" {
+			return nil
+		}
+
+		t, err := strconv.ParseUint(epoch, 10, 32)
+		if err != nil {
+			return ErrInvalidSourceDateEpoch
+		}
+
+		return Reproducible(time.Unix(int64(t), 0))(b)
+	}
+}
+
 func DefaultMode(m fs.FileMode) BuildOption {
 	return func(b *Builder) error {
 		b.defaultStat.perms = uint16(m & fs.ModePerm)
@@ -112,3 +181,16 @@ func Mode(m fs.FileMode) InodeOption {
 		c.perms = uint16(m)
 	}
 }
+
+// Xattr sets an extended attribute on the inode, replacing any previous value
+// set for the same name.
+//
+// The name must begin with one of the "user.", "trusted." or "security."
+// prefixes.
+func Xattr(name string, value []byte) InodeOption {
+	return func(c *commonStat) {
+		c.xattrs = append(slices.DeleteFunc(slices.Clone(c.xattrs), func(x xattr) bool {
+			return x.key == name
+		}), xattr{key: name, value: slices.Clone(value)})
+	}
+}
@@ -0,0 +1,278 @@
+package squashfs
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// AddPseudo reads mksquashfs pseudo file definitions from r, one per line,
+// and applies them to the image. Blank lines and lines beginning with '#' are
+// ignored.
+//
+// The following definitions are supported:
+//
+//	filename d mode uid gid                  create a directory
+//	filename m mode uid gid                  modify an existing entry
+//	filename b mode uid gid major minor      create a block device
+//	filename c mode uid gid major minor      create a char device
+//	filename p mode uid gid                  create a FIFO
+//	filename i mode uid gid s|f              create a socket or FIFO
+//	filename s mode uid gid target           create a symlink
+//	filename f mode uid gid command          create a file
+//	filename l target                        create a hard link
+//	filename x name=value                    set an extended attribute
+//
+// Filenames may be quoted with double quotes and may contain backslash
+// escapes. Modes are in octal, and uids and gids must be numeric. Extended
+// attribute values beginning with 0s are base64 encoded, and those beginning
+// with 0x are hex encoded.
+//
+// Commands are never executed; instead, the data for an f definition is
+// requested by passing its command to the given func. If that func is nil,
+// f definitions will return ErrNoPseudoCommand. If the returned reader is an
+// io.Closer, it will be closed once its data has been read.
+func (b *Builder) AddPseudo(r io.Reader, command func(string) (io.Reader, error)) error {
+	s := bufio.NewScanner(r)
+
+	for line := 1; s.Scan(); line++ {
+		if err := b.addPseudo(s.Text(), command); err != nil {
+			return fmt.Errorf("pseudo definition line %d: %w", line, err)
+		}
+	}
+
+	return s.Err()
+}
+
+func (b *Builder) addPseudo(line string, command func(string) (io.Reader, error)) error {
+	line = strings.TrimSpace(line)
+
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+
+	name, rest, err := pseudoName(line)
+	if err != nil {
+		return err
+	}
+
+	typ, rest := pseudoField(rest)
+
+	switch typ {
+	case "l":
+		target, _, err := pseudoName(rest)
+		if err != nil {
+			return err
+		}
+
+		return b.Link(name, target)
+	case "x":
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return ErrInvalidPseudo
+		}
+
+		x, err := pseudoXattr(key, value)
+		if err != nil {
+			return err
+		}
+
+		return b.modify(name, []InodeOption{Xattr(x.key, x.value)})
+	}
+
+	options, rest, err := pseudoOptions(rest)
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case "d":
+		return b.setDir(name, options)
+	case "m":
+		return b.modify(name, options)
+	case "b", "c":
+		major, minor, err := pseudoDevice(rest)
+		if err != nil {
+			return err
+		} else if typ == "b" {
+			return b.Block(name, encodeDevice(major, minor), options...)
+		}
+
+		return b.Char(name, encodeDevice(major, minor), options...)
+	case "p":
+		return b.FIFO(name, options...)
+	case "i":
+		switch rest {
+		case "s":
+			return b.Socket(name, options...)
+		case "f":
+			return b.FIFO(name, options...)
+		}
+	case "s":
+		if rest != "" {
+			return b.Symlink(name, rest, options...)
+		}
+	case "f":
+		if command == nil {
+			return ErrNoPseudoCommand
+		}
+
+		r, err := command(rest)
+		if err != nil {
+			return err
+		}
+
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+
+		return b.File(name, r, options...)
+	}
+
+	return ErrInvalidPseudo
+}
+
+func pseudoName(line string) (string, string, error) {
+	var (
+		name   strings.Builder
+		quoted bool
+	)
+
+	for n := 0; n < len(line); n++ {
+		switch c := line[n]; c {
+		case '\\':
+			if n++; n == len(line) {
+				return "", "", ErrInvalidPseudo
+			}
+
+			name.WriteByte(line[n])
+		case '"':
+			quoted = !quoted
+		case ' ', '\t':
+			if !quoted {
+				return tarPath("", name.String()), strings.TrimSpace(line[n:]), nil
+			}
+
+			fallthrough
+		default:
+			name.WriteByte(c)
+		}
+	}
+
+	if quoted || name.Len() == 0 {
+		return "", "", ErrInvalidPseudo
+	}
+
+	return tarPath("", name.String()), "", nil
+}
+
+func pseudoField(line string) (string, string) {
+	if n := strings.IndexAny(line, " \t"); n >= 0 {
+		return line[:n], strings.TrimSpace(line[n:])
+	}
+
+	return line, ""
+}
+
+func pseudoXattr(key, value string) (xattr, error) {
+	x := xattr{key: key, value: []byte(value)}
+
+	if len(value) >= 2 && value[0] == '0' {
+		var err error
+
+		switch value[1] {
+		case 's', 'S':
+			x.value, err = base64.StdEncoding.DecodeString(value[2:])
+		case 'x', 'X':
+			x.value, err = hex.DecodeString(value[2:])
+		}
+
+		if err != nil {
+			return x, ErrInvalidPseudo
+		}
+	}
+
+	return x, validateXattr(x)
+}
+
+func pseudoOptions(line string) ([]InodeOption, string, error) {
+	mode, line := pseudoField(line)
+	uid, line := pseudoField(line)
+	gid, line := pseudoField(line)
+
+	m, err := strconv.ParseUint(mode, 8, 12)
+	if err != nil {
+		return nil, "", ErrInvalidPseudo
+	}
+
+	u, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return nil, "", ErrInvalidPseudo
+	}
+
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, "", ErrInvalidPseudo
+	}
+
+	return []InodeOption{Mode(fs.FileMode(m)), Owner(uint32(u), uint32(g))}, line, nil
+}
+
+const (
+	maxDeviceMajor = 0xfff
+	maxDeviceMinor = 0xfffff
+)
+
+func pseudoDevice(line string) (int64, int64, error) {
+	major, line := pseudoField(line)
+	minor, line := pseudoField(line)
+
+	if line != "" {
+		return 0, 0, ErrInvalidPseudo
+	}
+
+	ma, err := strconv.ParseUint(major, 10, 32)
+	if err != nil {
+		return 0, 0, ErrInvalidPseudo
+	}
+
+	mi, err := strconv.ParseUint(minor, 10, 32)
+	if err != nil {
+		return 0, 0, ErrInvalidPseudo
+	}
+
+	if ma > maxDeviceMajor || mi > maxDeviceMinor {
+		return 0, 0, fs.ErrInvalid
+	}
+
+	return int64(ma), int64(mi), nil
+}
+
+// modify applies the given options to an existing entry.
+func (b *Builder) modify(p string, options []InodeOption) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var c *commonStat
+
+	if p == "." {
+		c = &b.root.commonStat
+	} else if n := b.root.getNode(p); n == nil {
+		return fs.ErrNotExist
+	} else if d := n.AsDir(); d != nil {
+		c = &d.commonStat
+	} else {
+		c = n.node().stat.common()
+	}
+
+	for _, opt := range options {
+		opt(c)
+	}
+
+	return nil
+}
@@ -49,7 +49,7 @@ func (r *resolver) resolve(root fs.FileInfo, resolveLast bool) (curr fs.FileInfo
 			return nil, fs.ErrInvalid
 		} else if name := r.splitOffNamePart(); isEmptyName(name) {
 			continue
-		} else if curr, err = r.getDirEntry(name, dir.blockIndex, dir.blockOffset, dir.fileSize); err != nil {
+		} else if curr, err = r.getDirEntry(name, dir); err != nil {
 			return nil, err
 		} else if r.isDone(resolveLast) {
 			break
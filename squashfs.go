@@ -44,6 +44,10 @@ func (s *SquashFS) open(path string) (fs.File, error) {
 		return nil, err
 	}
 
+	return s.openEntry(f)
+}
+
+func (s *SquashFS) openEntry(f fs.FileInfo) (fs.File, error) {
 	switch f := f.(type) {
 	case fileStat:
 		return &file{
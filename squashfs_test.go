@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"testing/fstest"
@@ -607,3 +608,96 @@ func TestReadlink(t *testing.T) {
 		}),
 	)
 }
+
+func TestXattr(t *testing.T) {
+	test(
+		t,
+		false,
+		[]testFn{
+			func(sfs *SquashFS) error {
+				keys, err := sfs.ListXattr("childA")
+				if err != nil {
+					return fmt.Errorf("got unexpected error: %s", err)
+				} else if len(keys) != 0 {
+					return fmt.Errorf("expecting no xattrs, got %v", keys)
+				}
+
+				return nil
+			},
+			func(sfs *SquashFS) error {
+				keys, err := sfs.ListXattr("childB")
+				if err != nil {
+					return fmt.Errorf("got unexpected error: %s", err)
+				}
+
+				slices.Sort(keys)
+
+				if expected := []string{"security.selinux", "user.comment"}; !slices.Equal(keys, expected) {
+					return fmt.Errorf("expecting xattrs %v, got %v", expected, keys)
+				}
+
+				return nil
+			},
+			func(sfs *SquashFS) error {
+				const expected = "system_u:object_r:bin_t:s0"
+
+				value, err := sfs.GetXattr("childB", "security.selinux")
+				if err != nil {
+					return fmt.Errorf("got unexpected error: %s", err)
+				} else if string(value) != expected {
+					return fmt.Errorf("expecting value %q, got %q", expected, value)
+				}
+
+				return nil
+			},
+			func(sfs *SquashFS) error {
+				_, err := sfs.GetXattr("childB", "user.missing")
+				if !errors.Is(err, ErrNoXattr) {
+					return fmt.Errorf("expecting error ErrNoXattr, got %s", err)
+				}
+
+				return nil
+			},
+			func(sfs *SquashFS) error {
+				const expected = "a directory"
+
+				f, err := sfs.Open("dirC")
+				if err != nil {
+					return fmt.Errorf("got unexpected error: %s", err)
+				}
+
+				value, err := f.(*dir).GetXattr("user.comment")
+				if err != nil {
+					return fmt.Errorf("got unexpected error: %s", err)
+				} else if string(value) != expected {
+					return fmt.Errorf("expecting value %q, got %q", expected, value)
+				}
+
+				return nil
+			},
+			func(sfs *SquashFS) error {
+				const expected = "a link"
+
+				value, err := sfs.GetXattr("symD", "user.comment")
+				if err != nil {
+					return fmt.Errorf("got unexpected error: %s", err)
+				} else if string(value) != "a file" {
+					return fmt.Errorf("expecting value %q, got %q", "a file", value)
+				}
+
+				value, err = sfs.LGetXattr("symD", "user.comment")
+				if err != nil {
+					return fmt.Errorf("got unexpected error: %s", err)
+				} else if string(value) != expected {
+					return fmt.Errorf("expecting value %q, got %q", expected, value)
+				}
+
+				return nil
+			},
+		},
+		fileData("childA", contentsA),
+		fileData("childB", contentsA, setXattr("security.selinux", "system_u:object_r:bin_t:s0"), setXattr("user.comment", "a file")),
+		dirData("dirC", []child{}, setXattr("user.comment", "a directory")),
+		symlink("symD", "childB", setXattr("user.comment", "a link")),
+	)
+}
@@ -11,12 +11,16 @@ import (
 )
 
 const (
-	headerLength             = 104
-	compressionOptionsLength = 4
-	magic                    = 0x73717368 // hsqs
-	versionMajor             = 4
-	versionMinor             = 0
-	flagCompressionOptions   = 0x400
+	superblockLength            = 96
+	maxCompressionOptionsLength = 8
+	headerLength                = superblockLength + blockHeaderSize + maxCompressionOptionsLength
+	magic                       = 0x73717368 // hsqs
+	versionMajor                = 4
+	versionMinor                = 0
+	flagExportable              = 0x80
+	flagCompressionOptions      = 0x400
+
+	exportLength = 8
 )
 
 type superblock struct {
@@ -50,7 +54,12 @@ func (s *superblock) readFrom(r io.Reader) error {
 		return err
 	}
 
-	s.CompressionOptions, err = s.Compressor.parseOptions(s.Flags&flagCompressionOptions != 0, &ler)
+	hasOptions := s.Flags&flagCompressionOptions != 0
+	if hasOptions {
+		ler.ReadUint16() // metadata block header
+	}
+
+	s.CompressionOptions, err = s.Compressor.parseOptions(hasOptions, &ler)
 
 	return err
 }
@@ -85,6 +94,15 @@ func (s *superblock) readSuperBlockDetails(ler *byteio.StickyLittleEndianReader)
 	return nil
 }
 
+func (s *superblock) dataStart() int64 {
+	start := int64(superblockLength)
+	if s.Flags&flagCompressionOptions != 0 {
+		start += blockHeaderSize + compressionOptionsLength(s.CompressionOptions)
+	}
+
+	return start
+}
+
 func (s *superblock) writeTo(w io.Writer) error {
 	if s.ModTime.IsZero() {
 		s.ModTime = time.Now()
@@ -119,10 +137,19 @@ func (s *superblock) writeTo(w io.Writer) error {
 
 func (s *superblock) writeCompressionOptions(lew *byteio.StickyLittleEndianWriter) {
 	if s.Flags&flagCompressionOptions != 0 {
-		s.CompressionOptions.writeTo(lew)
+		lew.WriteUint16(uint16(compressionOptionsLength(s.CompressionOptions)) | metadataBlockCompressedMask)
+		s.CompressionOptions.WriteOptions(lew)
 	}
 }
 
+func compressionOptionsLength(c CompressorOptions) int64 {
+	lew := byteio.StickyLittleEndianWriter{Writer: io.Discard}
+
+	c.WriteOptions(&lew)
+
+	return lew.Count
+}
+
 // Type Stats contains basic data about the SquashFS file, read from the
 // superblock.
 type Stats struct {
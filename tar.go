@@ -0,0 +1,100 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// AddTar reads the given tar archive, adding all of its entries to the image
+// under the given prefix, which may be empty or "." to add the entries to the
+// root.
+//
+// Ownership, permissions, modification times and PAX extended attributes of
+// each entry are preserved. Hard links must refer to an entry earlier in the
+// archive. Extended attributes whose namespace cannot be stored in a SquashFS
+// image, such as system.posix_acl_access, are skipped, as are global PAX
+// headers.
+//
+// As on Linux, symlinks are always given full permissions.
+func (b *Builder) AddTar(prefix string, r io.Reader) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err = b.addTarEntry(prefix, hdr, tr); err != nil {
+			return &fs.PathError{
+				Op:   "addtar",
+				Path: hdr.Name,
+				Err:  err,
+			}
+		}
+	}
+}
+
+func (b *Builder) addTarEntry(prefix string, hdr *tar.Header, r io.Reader) error {
+	p := tarPath(prefix, hdr.Name)
+	options := tarOptions(hdr)
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return b.File(p, r, options...)
+	case tar.TypeDir:
+		return b.setDir(p, options)
+	case tar.TypeSymlink:
+		return b.Symlink(p, hdr.Linkname, append(options, Mode(fs.ModePerm))...)
+	case tar.TypeLink:
+		return b.Link(p, tarPath(prefix, hdr.Linkname))
+	case tar.TypeBlock:
+		return b.Block(p, encodeDevice(hdr.Devmajor, hdr.Devminor), options...)
+	case tar.TypeChar:
+		return b.Char(p, encodeDevice(hdr.Devmajor, hdr.Devminor), options...)
+	case tar.TypeFifo:
+		return b.FIFO(p, options...)
+	case tar.TypeXGlobalHeader:
+		return nil
+	}
+
+	return fs.ErrInvalid
+}
+
+func tarPath(prefix, name string) string {
+	if p := path.Join(prefix, strings.TrimPrefix(path.Clean("/"+name), "/")); p != "" {
+		return p
+	}
+
+	return "."
+}
+
+func tarOptions(hdr *tar.Header) []InodeOption {
+	options := []InodeOption{
+		Owner(uint32(hdr.Uid), uint32(hdr.Gid)),
+		Mode(fs.FileMode(hdr.Mode & 0o7777)),
+		ModTime(hdr.ModTime),
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); !ok {
+			continue
+		} else if _, suffix := xattrType(name); suffix != "" {
+			options = append(options, Xattr(name, []byte(value)))
+		}
+	}
+
+	return options
+}
+
+func encodeDevice(major, minor int64) uint32 {
+	return uint32(minor&0xff | major<<8 | (minor&^0xff)<<12)
+}
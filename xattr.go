@@ -0,0 +1,291 @@
+package squashfs
+
+import (
+	"io"
+	"io/fs"
+
+	"vimagination.zapto.org/byteio"
+)
+
+const (
+	xattrTypeUser     = 0
+	xattrTypeTrusted  = 1
+	xattrTypeSecurity = 2
+
+	xattrTypeMask  = 0xff
+	xattrValueOOL  = 0x100
+	xattrOOLLength = 8
+
+	xattrIDLength          = 16
+	xattrTableHeaderLength = 16
+	maxXattrValueLength    = 1 << 16
+)
+
+var xattrPrefixes = [...]string{
+	xattrTypeUser:     "user.",
+	xattrTypeTrusted:  "trusted.",
+	xattrTypeSecurity: "security.",
+}
+
+type xattr struct {
+	key   string
+	value []byte
+}
+
+// ListXattr returns the names of the extended attributes of the named file,
+// following symlinks.
+func (s *SquashFS) ListXattr(path string) ([]string, error) {
+	return s.listXattr("listxattr", path, true)
+}
+
+// LListXattr acts like ListXattr, but does not follow a final symlink.
+func (s *SquashFS) LListXattr(path string) ([]string, error) {
+	return s.listXattr("llistxattr", path, false)
+}
+
+func (s *SquashFS) listXattr(op, path string, resolveLast bool) ([]string, error) {
+	xattrs, err := s.pathXattrs(path, resolveLast)
+	if err != nil {
+		return nil, &fs.PathError{
+			Op:   op,
+			Path: path,
+			Err:  err,
+		}
+	}
+
+	return xattrKeys(xattrs), nil
+}
+
+// GetXattr returns the value of the named extended attribute of the named
+// file, following symlinks.
+func (s *SquashFS) GetXattr(path, name string) ([]byte, error) {
+	return s.getXattr("getxattr", path, name, true)
+}
+
+// LGetXattr acts like GetXattr, but does not follow a final symlink.
+func (s *SquashFS) LGetXattr(path, name string) ([]byte, error) {
+	return s.getXattr("lgetxattr", path, name, false)
+}
+
+func (s *SquashFS) getXattr(op, path, name string, resolveLast bool) ([]byte, error) {
+	xattrs, err := s.pathXattrs(path, resolveLast)
+	if err == nil {
+		var value []byte
+
+		if value, err = xattrValue(xattrs, name); err == nil {
+			return value, nil
+		}
+	}
+
+	return nil, &fs.PathError{
+		Op:   op,
+		Path: path,
+		Err:  err,
+	}
+}
+
+func (s *SquashFS) pathXattrs(path string, resolveLast bool) ([]xattr, error) {
+	fi, err := s.resolve(path, resolveLast)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readXattrs(xattrIndex(fi))
+}
+
+func xattrIndex(fi fs.FileInfo) uint32 {
+	switch fi := fi.(type) {
+	case dirStat:
+		return fi.xattrIndex
+	case fileStat:
+		return fi.xattrIndex
+	case symlinkStat:
+		return fi.xattrIndex
+	case blockStat:
+		return fi.xattrIndex
+	case charStat:
+		return fi.xattrIndex
+	case fifoStat:
+		return fi.xattrIndex
+	case socketStat:
+		return fi.xattrIndex
+	}
+
+	return fieldDisabled
+}
+
+func xattrKeys(xattrs []xattr) []string {
+	keys := make([]string, len(xattrs))
+
+	for n, x := range xattrs {
+		keys[n] = x.key
+	}
+
+	return keys
+}
+
+func xattrValue(xattrs []xattr, name string) ([]byte, error) {
+	for _, x := range xattrs {
+		if x.key == name {
+			return x.value, nil
+		}
+	}
+
+	return nil, ErrNoXattr
+}
+
+func (s *SquashFS) readXattrs(index uint32) ([]xattr, error) {
+	if index == fieldDisabled || s.superblock.XattrTable == noTable {
+		return nil, nil
+	}
+
+	ler := byteio.StickyLittleEndianReader{
+		Reader: io.NewSectionReader(s.reader, int64(s.superblock.XattrTable), xattrTableHeaderLength),
+	}
+
+	start := ler.ReadUint64()
+	count := ler.ReadUint32()
+
+	if ler.Err != nil {
+		return nil, ler.Err
+	} else if index >= count {
+		return nil, fs.ErrInvalid
+	}
+
+	r, err := s.readMetadataFromLookupTable(int64(s.superblock.XattrTable)+xattrTableHeaderLength, int64(index), xattrIDLength)
+	if err != nil {
+		return nil, err
+	}
+
+	ler.Reader = r
+	ref := ler.ReadUint64()
+	num := ler.ReadUint32()
+
+	if ler.Err != nil {
+		return nil, ler.Err
+	}
+
+	if ler.Reader, err = s.readMetadata(ref, start); err != nil {
+		return nil, err
+	}
+
+	var xattrs []xattr
+
+	for range num {
+		x, err := s.readXattr(&ler, start)
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs = append(xattrs, x)
+	}
+
+	return xattrs, nil
+}
+
+func (s *SquashFS) readXattr(ler *byteio.StickyLittleEndianReader, start uint64) (xattr, error) {
+	typ := ler.ReadUint16()
+	name := ler.ReadString16()
+
+	if typ&xattrTypeMask >= uint16(len(xattrPrefixes)) {
+		return xattr{}, ErrInvalidXattr
+	}
+
+	var value []byte
+
+	if typ&xattrValueOOL == 0 {
+		value = readXattrValue(ler)
+	} else if ler.ReadUint32() != xattrOOLLength {
+		return xattr{}, ErrInvalidXattr
+	} else if r, err := s.readMetadata(ler.ReadUint64(), start); err != nil {
+		return xattr{}, err
+	} else {
+		oler := byteio.StickyLittleEndianReader{Reader: r}
+
+		if value = readXattrValue(&oler); oler.Err != nil {
+			return xattr{}, oler.Err
+		}
+	}
+
+	if ler.Err != nil {
+		return xattr{}, ler.Err
+	}
+
+	return xattr{key: xattrPrefixes[typ&xattrTypeMask] + name, value: value}, nil
+}
+
+func readXattrValue(ler *byteio.StickyLittleEndianReader) []byte {
+	size := ler.ReadUint32()
+	if size > maxXattrValueLength {
+		if ler.Err == nil {
+			ler.Err = ErrInvalidXattr
+		}
+
+		return nil
+	}
+
+	return []byte(ler.ReadString(int(size)))
+}
+
+// ListXattr returns the names of the extended attributes of the file.
+func (f *file) ListXattr() ([]string, error) {
+	xattrs, err := f.xattrs()
+	if err != nil {
+		return nil, err
+	}
+
+	return xattrKeys(xattrs), nil
+}
+
+// GetXattr returns the value of the named extended attribute of the file.
+func (f *file) GetXattr(name string) ([]byte, error) {
+	xattrs, err := f.xattrs()
+	if err != nil {
+		return nil, err
+	}
+
+	return xattrValue(xattrs, name)
+}
+
+func (f *file) xattrs() ([]xattr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.squashfs == nil {
+		return nil, fs.ErrClosed
+	}
+
+	return f.squashfs.readXattrs(f.file.xattrIndex)
+}
+
+// ListXattr returns the names of the extended attributes of the directory.
+func (d *dir) ListXattr() ([]string, error) {
+	xattrs, err := d.xattrs()
+	if err != nil {
+		return nil, err
+	}
+
+	return xattrKeys(xattrs), nil
+}
+
+// GetXattr returns the value of the named extended attribute of the
+// directory.
+func (d *dir) GetXattr(name string) ([]byte, error) {
+	xattrs, err := d.xattrs()
+	if err != nil {
+		return nil, err
+	}
+
+	return xattrValue(xattrs, name)
+}
+
+func (d *dir) xattrs() ([]xattr, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.squashfs == nil {
+		return nil, fs.ErrClosed
+	}
+
+	return d.squashfs.readXattrs(d.dir.xattrIndex)
+}
@@ -0,0 +1,481 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"slices"
+
+	"github.com/ulikunitz/xz/lzma"
+	"vimagination.zapto.org/memio"
+)
+
+const (
+	xzFilterLZMA2 = 0x21
+
+	xzCheckNone   = 0x00
+	xzCheckCRC32  = 0x01
+	xzCheckCRC64  = 0x04
+	xzCheckSHA256 = 0x0a
+
+	xzHeaderLength     = 12
+	xzMaxDictProp      = 40
+	xzBlockFlagsFilter = 0x03
+	xzBlockFlagsComp   = 0x40
+	xzBlockFlagsUncomp = 0x80
+	xzBlockFlagsRes    = 0x3c
+	xzMaxVLILength     = 9
+
+	maxBCJFilters = 6
+)
+
+var (
+	xzHeaderMagic = [...]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = [...]byte{'Y', 'Z'}
+
+	crc64Table = crc64.MakeTable(crc64.ECMA)
+)
+
+func decompressXZ(r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bytes.NewReader(data)
+
+	check, err := readXZStreamHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+
+	for {
+		block, err := readXZBlock(br, check)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, block...)
+	}
+
+	return bytes.NewReader(buf), nil
+}
+
+func readXZStreamHeader(br *bytes.Reader) (byte, error) {
+	var header [xzHeaderLength]byte
+
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(header[:len(xzHeaderMagic)], xzHeaderMagic[:]) || header[6] != 0 || header[7]&0xf0 != 0 {
+		return 0, ErrInvalidXZStream
+	}
+
+	if crc32.ChecksumIEEE(header[6:8]) != binary.LittleEndian.Uint32(header[8:]) {
+		return 0, ErrInvalidChecksum
+	}
+
+	return header[7], nil
+}
+
+type xzFilter struct {
+	id    uint64
+	props []byte
+}
+
+func readXZBlock(br *bytes.Reader, check byte) ([]byte, error) {
+	filters, err := readXZBlockHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	lzma2 := filters[len(filters)-1]
+	if lzma2.id != xzFilterLZMA2 || len(lzma2.props) != 1 || lzma2.props[0] > xzMaxDictProp {
+		return nil, ErrInvalidXZStream
+	}
+
+	lr, err := lzma.Reader2Config{
+		DictCap: min(max(int(xzDictSize(lzma2.props[0])), lzma.MinDictCap), maxBlockSize),
+	}.NewReader2(br)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(lr, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxBlockSize {
+		return nil, ErrInvalidXZStream
+	}
+
+	if err := skipXZPadding(br); err != nil {
+		return nil, err
+	}
+
+	for n := len(filters) - 2; n >= 0; n-- {
+		if err := applyBCJFilter(filters[n], data, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := verifyXZCheck(br, check, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func readXZBlockHeader(br *bytes.Reader) ([]xzFilter, error) {
+	size, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if size == 0 {
+		return nil, io.EOF
+	}
+
+	header := make([]byte, (int(size)+1)*4)
+	header[0] = size
+
+	if _, err := io.ReadFull(br, header[1:]); err != nil {
+		return nil, err
+	}
+
+	crcPos := len(header) - 4
+
+	if crc32.ChecksumIEEE(header[:crcPos]) != binary.LittleEndian.Uint32(header[crcPos:]) {
+		return nil, ErrInvalidChecksum
+	}
+
+	hr := bytes.NewReader(header[1:crcPos])
+
+	flags, _ := hr.ReadByte()
+	if flags&xzBlockFlagsRes != 0 {
+		return nil, ErrInvalidXZStream
+	}
+
+	if flags&xzBlockFlagsComp != 0 {
+		if _, err := readXZVLI(hr); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags&xzBlockFlagsUncomp != 0 {
+		if _, err := readXZVLI(hr); err != nil {
+			return nil, err
+		}
+	}
+
+	filters := make([]xzFilter, flags&xzBlockFlagsFilter+1)
+
+	for n := range filters {
+		if filters[n], err = readXZFilter(hr); err != nil {
+			return nil, err
+		}
+	}
+
+	return filters, nil
+}
+
+func readXZFilter(r *bytes.Reader) (xzFilter, error) {
+	id, err := readXZVLI(r)
+	if err != nil {
+		return xzFilter{}, err
+	}
+
+	size, err := readXZVLI(r)
+	if err != nil {
+		return xzFilter{}, err
+	} else if size > uint64(r.Len()) {
+		return xzFilter{}, ErrInvalidXZStream
+	}
+
+	props := make([]byte, size)
+
+	_, err = io.ReadFull(r, props)
+
+	return xzFilter{id: id, props: props}, err
+}
+
+func readXZVLI(r io.ByteReader) (uint64, error) {
+	var n uint64
+
+	for i := 0; i < xzMaxVLILength; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		n |= uint64(b&0x7f) << (7 * i)
+
+		if b&0x80 == 0 {
+			if b == 0 && i > 0 {
+				return 0, ErrInvalidXZStream
+			}
+
+			return n, nil
+		}
+	}
+
+	return 0, ErrInvalidXZStream
+}
+
+func skipXZPadding(br *bytes.Reader) error {
+	for (br.Size()-int64(br.Len()))%4 != 0 {
+		if b, err := br.ReadByte(); err != nil {
+			return err
+		} else if b != 0 {
+			return ErrInvalidXZStream
+		}
+	}
+
+	return nil
+}
+
+func xzCheckSize(check byte) int {
+	if check == xzCheckNone {
+		return 0
+	}
+
+	return 4 << ((check - 1) / 3)
+}
+
+func xzCheckHash(check byte) hash.Hash {
+	switch check {
+	case xzCheckCRC32:
+		return crc32.NewIEEE()
+	case xzCheckCRC64:
+		return crc64.New(crc64Table)
+	case xzCheckSHA256:
+		return sha256.New()
+	}
+
+	return nil
+}
+
+func verifyXZCheck(br *bytes.Reader, check byte, data []byte) error {
+	sum := make([]byte, xzCheckSize(check))
+
+	if _, err := io.ReadFull(br, sum); err != nil {
+		return err
+	}
+
+	h := xzCheckHash(check)
+	if h == nil {
+		return nil
+	}
+
+	h.Write(data)
+
+	expected := h.Sum(nil)
+	if check != xzCheckSHA256 {
+		slices.Reverse(expected)
+	}
+
+	if !bytes.Equal(expected, sum) {
+		return ErrInvalidChecksum
+	}
+
+	return nil
+}
+
+func applyBCJFilter(f xzFilter, data []byte, encode bool) error {
+	filter, ok := bcjFilters[f.id]
+	if !ok {
+		return ErrUnsupportedXZFilter
+	}
+
+	var start uint32
+
+	switch len(f.props) {
+	case 0:
+	case 4:
+		start = binary.LittleEndian.Uint32(f.props)
+	default:
+		return ErrInvalidXZStream
+	}
+
+	filter(data, start, encode)
+
+	return nil
+}
+
+func xzDictSize(prop byte) uint32 {
+	if prop == xzMaxDictProp {
+		return 0xffffffff
+	}
+
+	return (2 | uint32(prop)&1) << (prop/2 + 11)
+}
+
+func xzDictProp(size uint32) byte {
+	var prop byte
+
+	for prop < xzMaxDictProp && xzDictSize(prop) < size {
+		prop++
+	}
+
+	return prop
+}
+
+type xzWriter struct {
+	w       io.Writer
+	buf     memio.Buffer
+	dictCap uint32
+	filters []uint64
+}
+
+func newXZWriter(dictionarySize, filters uint32) *xzWriter {
+	x := &xzWriter{
+		dictCap: max(dictionarySize, lzma.MinDictCap),
+	}
+
+	for n := range maxBCJFilters {
+		if filters&(1<<n) != 0 {
+			x.filters = append(x.filters, bcjX86+uint64(n))
+		}
+	}
+
+	return x
+}
+
+func (x *xzWriter) Reset(w io.Writer) {
+	x.w = w
+	x.buf = x.buf[:0]
+}
+
+func (x *xzWriter) Write(p []byte) (int, error) {
+	return x.buf.Write(p)
+}
+
+func (x *xzWriter) Close() error {
+	best, err := x.encode(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range x.filters {
+		out, err := x.encode(&xzFilter{id: id})
+		if err != nil {
+			return err
+		}
+
+		if len(out) < len(best) {
+			best = out
+		}
+	}
+
+	_, err = x.w.Write(best)
+
+	return err
+}
+
+func (x *xzWriter) encode(filter *xzFilter) ([]byte, error) {
+	data := []byte(x.buf)
+
+	if filter != nil {
+		data = slices.Clone(data)
+
+		if err := applyBCJFilter(*filter, data, true); err != nil {
+			return nil, err
+		}
+	}
+
+	out := memio.Buffer(slices.Clone(xzHeaderMagic[:]))
+	out = append(out, 0, xzCheckCRC32)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out[6:8]))
+
+	blockStart := len(out)
+
+	out = x.appendBlockHeader(out, filter)
+
+	lw, err := lzma.Writer2Config{DictCap: int(x.dictCap)}.NewWriter2(&out)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = lw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err = lw.Close(); err != nil {
+		return nil, err
+	}
+
+	unpaddedSize := len(out) - blockStart + xzCheckSize(xzCheckCRC32)
+
+	out = appendXZPadding(out)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(x.buf))
+
+	indexStart := len(out)
+
+	out = append(out, 0)
+	out = appendXZVLI(out, 1)
+	out = appendXZVLI(out, uint64(unpaddedSize))
+	out = appendXZVLI(out, uint64(len(x.buf)))
+	out = appendXZPadding(out)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out[indexStart:]))
+
+	footerStart := len(out) + 4
+
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	out = binary.LittleEndian.AppendUint32(out, uint32((footerStart-4-indexStart)/4-1))
+	out = append(out, 0, xzCheckCRC32)
+	binary.LittleEndian.PutUint32(out[footerStart-4:], crc32.ChecksumIEEE(out[footerStart:]))
+	out = append(out, xzFooterMagic[:]...)
+
+	return out, nil
+}
+
+func (x *xzWriter) appendBlockHeader(out []byte, filter *xzFilter) []byte {
+	start := len(out)
+	flags := byte(0)
+
+	if filter != nil {
+		flags = 1
+	}
+
+	out = append(out, 0, flags)
+
+	if filter != nil {
+		out = appendXZVLI(out, filter.id)
+		out = appendXZVLI(out, 0)
+	}
+
+	out = appendXZVLI(out, xzFilterLZMA2)
+	out = appendXZVLI(out, 1)
+	out = append(out, xzDictProp(x.dictCap))
+
+	for (len(out)-start)%4 != 0 {
+		out = append(out, 0)
+	}
+
+	out[start] = byte((len(out) - start) / 4)
+
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+func appendXZVLI(out []byte, n uint64) []byte {
+	for n >= 0x80 {
+		out = append(out, byte(n)|0x80)
+		n >>= 7
+	}
+
+	return append(out, byte(n))
+}
+
+func appendXZPadding(out []byte) []byte {
+	for len(out)%4 != 0 {
+		out = append(out, 0)
+	}
+
+	return out
+}
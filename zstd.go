@@ -0,0 +1,36 @@
+package squashfs
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxBlockSize))
+})
+
+func decompressZStd(r io.Reader) (io.Reader, error) {
+	d, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := d.DecodeAll(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(buf), nil
+}
+
+func newZStdWriter(compressionLevel uint32) (CompressedWriter, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(int(compressionLevel))), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(maxBlockSize))
+}